@@ -19,16 +19,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"fmt"
 	"html"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"humungus.tedunangst.com/r/webs/httpsig"
 	"humungus.tedunangst.com/r/webs/junk"
 )
@@ -41,8 +43,11 @@ var apTypes = []string{
 }
 var apBestType = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
 
-var serverPubKey = "somekey"
-var serverPrivateKey httpsig.PrivateKey
+func apLoadIdentity() {
+	getconfig("servername", &serverName)
+	serverURL = "https://" + serverName
+	apLoadKeys()
+}
 
 func isActivity(ct string) bool {
 	ct = strings.ToLower(ct)
@@ -54,20 +59,6 @@ func isActivity(ct string) bool {
 	return false
 }
 
-func apDeliver(tries int, rcpt string, msg []byte) error {
-	if tries > 0 {
-		time.Sleep(1 * time.Hour)
-	}
-	err := postMsg(rcpt, msg)
-	if err != nil {
-		log.Printf("error posting to %s: %s", rcpt, err)
-		if tries != -1 && tries < 3 {
-			go apDeliver(tries+1, rcpt, msg)
-		}
-	}
-	return err
-}
-
 func oneLink(linkid int64) *Link {
 	rows, err := stmtGetLink.Query(linkid)
 	links, _ := readlinks(rows, err)
@@ -80,12 +71,33 @@ func oneLink(linkid int64) *Link {
 func apHandle(w http.ResponseWriter, r *http.Request, linkid int64) {
 	w.Header().Set("Cache-Control", "max-age=300")
 	if r.URL.Path == "/" {
-		apActor(w, r)
+		apActor(w, r, nil)
+		return
+	}
+	if name := mux.Vars(r)["collection"]; name != "" {
+		c := getcollection(name)
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		apActor(w, r, c)
 		return
 	}
 	link := oneLink(linkid)
+	if link != nil && (link.Visibility == "private" || link.Queued()) {
+		link = nil
+	}
 	if link == nil {
-		http.NotFound(w, r)
+		dt := gettombstone(linkid)
+		if dt == "" {
+			http.NotFound(w, r)
+			return
+		}
+		j := apTombstone(linkid, dt)
+		j["@context"] = apContext
+		w.Header().Set("Content-Type", apBestType)
+		w.WriteHeader(http.StatusGone)
+		j.Write(w)
 		return
 	}
 
@@ -96,15 +108,46 @@ func apHandle(w http.ResponseWriter, r *http.Request, linkid int64) {
 	jlink.Write(w)
 }
 
+// apFinger answers for inks and each of the collections
 func apFinger(w http.ResponseWriter, r *http.Request) {
+	var c *Collection
+	name := "inks"
+	resource := r.FormValue("resource")
+	if strings.HasPrefix(resource, "https://") {
+		cid, ok := actorcollection(resource)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if cid != 0 {
+			name = resource[strings.LastIndexByte(resource, '/')+1:]
+		}
+	} else if resource != "" {
+		resource = strings.TrimPrefix(resource, "acct:")
+		if idx := strings.IndexByte(resource, '@'); idx != -1 {
+			if resource[idx+1:] != serverName {
+				http.NotFound(w, r)
+				return
+			}
+			resource = resource[:idx]
+		}
+		name = resource
+	}
+	if name != "inks" {
+		c = getcollection(name)
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
 	j := junk.New()
-	j["subject"] = fmt.Sprintf("acct:%s@%s", "inks", serverName)
-	j["aliases"] = []string{serverURL}
+	j["subject"] = fmt.Sprintf("acct:%s@%s", name, serverName)
+	j["aliases"] = []string{c.URL()}
 	var links []junk.Junk
 	l := junk.New()
 	l["rel"] = "self"
 	l["type"] = `application/activity+json`
-	l["href"] = serverURL
+	l["href"] = c.URL()
 	links = append(links, l)
 	j["links"] = links
 
@@ -112,30 +155,36 @@ func apFinger(w http.ResponseWriter, r *http.Request) {
 	j.Write(w)
 }
 
-func apActor(w http.ResponseWriter, r *http.Request) {
+// apActorJunk returns the main actor for a nil collection
+func apActorJunk(c *Collection) junk.Junk {
+	id := c.URL()
 	j := junk.New()
 	j["@context"] = apContext
-	j["id"] = serverURL
+	j["id"] = id
 	j["type"] = "Application"
-	j["inbox"] = serverURL + "/inbox"
-	j["outbox"] = serverURL + "/outbox"
-	j["followers"] = serverURL + "/followers"
-	j["following"] = serverURL + "/following"
-	j["name"] = serverName
+	j["inbox"] = id + "/inbox"
+	j["outbox"] = id + "/outbox"
+	j["followers"] = id + "/followers"
+	j["following"] = id + "/following"
 	j["preferredUsername"] = "inks"
-	j["summary"] = serverName
-	j["url"] = serverURL
-	a := junk.New()
-	a["type"] = "Image"
-	a["mediaType"] = "image/png"
-	a["url"] = serverURL + "/icon.png"
-	j["icon"] = a
-	k := junk.New()
-	k["id"] = serverURL + "#key"
-	k["owner"] = serverURL
-	k["publicKeyPem"] = serverPubKey
-	j["publicKey"] = k
+	j["url"] = id
+	e := junk.New()
+	e["sharedInbox"] = serverURL + "/inbox"
+	j["endpoints"] = e
+	apProfile(j)
+	if c != nil {
+		j["preferredUsername"] = c.Name
+		j["name"] = c.Title
+		j["summary"] = fmt.Sprintf(`<p>%s from <a href="%s">%s</a>`,
+			html.EscapeString(c.Title), serverURL, serverName)
+		delete(j, "attachment")
+	}
+	j["publicKey"] = apPublicKeys(id)
+	return j
+}
 
+func apActor(w http.ResponseWriter, r *http.Request, c *Collection) {
+	j := apActorJunk(c)
 	w.Header().Set("Content-Type", apBestType)
 	j.Write(w)
 }
@@ -169,14 +218,17 @@ func getBoxes(actor string) (*Box, error) {
 	return b, nil
 }
 
-func apAccept(req junk.Junk) {
+// apRespond sends an Accept or Reject for a follow request, from
+// whichever actor was followed
+func apRespond(what string, req junk.Junk) (*Box, error) {
 	actor, _ := req.GetString("actor")
+	us := objectid(req)
 
 	j := junk.New()
 	j["@context"] = apContext
-	j["id"] = serverURL + "/accept/" + randomxid()
-	j["type"] = "Accept"
-	j["actor"] = serverURL
+	j["id"] = us + "/" + strings.ToLower(what) + "/" + randomxid()
+	j["type"] = what
+	j["actor"] = us
 	j["to"] = actor
 	j["published"] = time.Now().UTC().Format(time.RFC3339)
 	j["object"] = req
@@ -187,12 +239,37 @@ func apAccept(req junk.Junk) {
 
 	box, err := getBoxes(actor)
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = apDeliver(-1, box.In, msg)
-	if err == nil {
-		stmtSaveFollower.Exec(actor)
+	err = postMsg(box.In, msg)
+	if err != nil {
+		log.Printf("error posting to %s: %s", box.In, err)
+		return nil, err
 	}
+	return box, nil
+}
+
+func apAccept(req junk.Junk) error {
+	cid, ok := actorcollection(objectid(req))
+	if !ok {
+		return fmt.Errorf("follow of unknown actor: %s", objectid(req))
+	}
+	box, err := apRespond("Accept", req)
+	if err != nil {
+		return err
+	}
+	actor, _ := req.GetString("actor")
+	inbox := box.Shared
+	if inbox == "" {
+		inbox = box.In
+	}
+	savefollower(actor, inbox, cid)
+	return nil
+}
+
+func apReject(req junk.Junk) error {
+	_, err := apRespond("Reject", req)
+	return err
 }
 
 func apPong(who string, obj string) {
@@ -207,7 +284,7 @@ func apPong(who string, obj string) {
 
 	box, err := getBoxes(who)
 	if err == nil {
-		err = apDeliver(-1, box.In, j.ToBytes())
+		err = postMsg(box.In, j.ToBytes())
 	}
 	if err != nil {
 		log.Printf("can't send pong: %s", err)
@@ -223,43 +300,66 @@ func apInbox(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("bad payload: %s", err)
 		http.Error(w, "bad payload", http.StatusNotAcceptable)
+		return
 	}
 	what, _ := j.GetString("type")
 	switch what {
 	case "Create":
+	case "Delete":
 	case "Follow":
+	case "Like":
+	case "Announce":
 	case "Undo":
 	case "Ping":
 	default:
 		return
 	}
+	who, _ := j.GetString("actor")
+	if isblocked(who) {
+		log.Printf("ignoring %s from blocked %s", what, who)
+		http.Error(w, "no", http.StatusForbidden)
+		return
+	}
 	keyname, err := httpsig.VerifyRequest(r, payload, httpsig.ActivityPubKeyGetter)
 	if err != nil {
 		log.Printf("httpsig error: %s", err)
 		return
 	}
-	who, _ := j.GetString("actor")
 	if !strings.HasPrefix(keyname, who) {
 		log.Printf("suspected forgery: %s vs %s", keyname, who)
 		return
 	}
 	switch what {
 	case "Create":
-		fd, _ := os.OpenFile("savedinbox.json", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		j.Write(fd)
-		io.WriteString(fd, "\n")
-		fd.Close()
+		obj, ok := j.GetMap("object")
+		if ok {
+			savereply(who, obj)
+		}
+	case "Delete":
+		deletereply(who, objectid(j))
+	case "Like", "Announce":
+		savereaction(who, j)
 	case "Follow":
 		obj, _ := j.GetString("object")
-		if obj == serverURL {
-			go apAccept(j)
+		if cid, ok := actorcollection(obj); ok {
+			if approveFollowers {
+				savepending(who, j, cid)
+			} else {
+				go apAccept(j)
+			}
 		}
 	case "Undo":
 		obj, ok := j.GetMap("object")
 		if ok {
 			what, _ := obj.GetString("type")
-			if what == "Follow" {
-				stmtDeleteFollower.Exec(who)
+			switch what {
+			case "Follow":
+				if cid, ok := actorcollection(objectid(obj)); ok {
+					stmtDeleteFollower.Exec(who, cid)
+					stmtDeletePending.Exec(who, cid)
+				}
+			case "Like", "Announce":
+				undoreaction(who, obj)
 			}
 		}
 	case "Ping":
@@ -292,6 +392,10 @@ func apNote(link *Link) junk.Junk {
 	j["summary"] = html.EscapeString(link.Title)
 	j["to"] = apPublic
 	j["cc"] = serverURL + "/followers"
+	if link.Visibility == "unlisted" {
+		j["to"] = serverURL + "/followers"
+		j["cc"] = apPublic
+	}
 	j["type"] = "Note"
 	j["url"] = j["id"]
 	var tags []junk.Junk
@@ -328,70 +432,177 @@ func apPublish(linkid int64, update bool) {
 		// wait a minute for things to settle
 		time.Sleep(1 * time.Minute)
 	}
+	apFederate(linkid, update)
+}
+
+// apFederate sends a link to followers now
+func apFederate(linkid int64, update bool) {
 	link := oneLink(linkid)
 	if link == nil {
 		return
 	}
+	if !link.Federated() {
+		// take back what was sent before
+		if update {
+			apUnpublish(linkid)
+		}
+		return
+	}
 	if update && link.Posted.After(time.Now().Add(-1*time.Minute)) {
 		log.Printf("skipping update for new link")
 		return
 	}
-	rows, err := stmtGetFollowers.Query()
+	j := apCreate(link, update)
+	apBroadcast(j, 0)
+	apAnnounceNew(link)
+}
+
+func apTombstone(linkid int64, dt string) junk.Junk {
+	j := junk.New()
+	j["id"] = fmt.Sprintf("%s/l/%d", serverURL, linkid)
+	j["type"] = "Tombstone"
+	j["formerType"] = "Note"
+	if t, err := time.Parse(dbtimeformat, dt); err == nil {
+		j["deleted"] = t.Format(time.RFC3339)
+	}
+	return j
+}
+
+func apUnpublish(linkid int64) {
+	j := junk.New()
+	j["actor"] = serverURL
+	j["id"] = fmt.Sprintf("%s/l/%d/delete", serverURL, linkid)
+	j["object"] = apTombstone(linkid, gettombstone(linkid))
+	j["published"] = time.Now().UTC().Format(time.RFC3339)
+	j["to"] = apPublic
+	j["cc"] = serverURL + "/followers"
+	j["type"] = "Delete"
+	apBroadcast(j, allCollections)
+}
+
+// apBroadcast sends to the followers of one collection, or all of them
+func apBroadcast(j junk.Junk, collectionid int64) {
+	var rows *sql.Rows
+	var err error
+	if collectionid == allCollections {
+		rows, err = stmtGetAllFollowers.Query()
+	} else {
+		rows, err = stmtGetFollowers.Query(collectionid)
+	}
 	if err != nil {
 		log.Printf("error getting followers")
 		return
 	}
 	defer rows.Close()
+	addrs := make(map[string]bool)
 	var actors []string
 	for rows.Next() {
-		var actor string
-		rows.Scan(&actor)
-		actors = append(actors, actor)
+		var actor, inbox string
+		rows.Scan(&actor, &inbox)
+		if isblocked(actor) || isblocked(inbox) {
+			continue
+		}
+		if inbox != "" {
+			addrs[inbox] = true
+		} else {
+			actors = append(actors, actor)
+		}
 	}
 	rows.Close()
-	addrs := make(map[string]bool)
+	// followers from before we saved their inbox
 	for _, actor := range actors {
 		box, _ := getBoxes(actor)
 		if box != nil {
-			if box.Shared != "" {
-				addrs[box.Shared] = true
-			} else {
-				addrs[box.In] = true
+			inbox := box.Shared
+			if inbox == "" {
+				inbox = box.In
+			}
+			stmtSetFollowerInbox.Exec(inbox, actor)
+			if !isblocked(inbox) {
+				addrs[inbox] = true
 			}
 		}
 	}
-	j := apCreate(link, update)
 	j["@context"] = apContext
 	var buf bytes.Buffer
 	j.Write(&buf)
 	msg := buf.Bytes()
 	for addr := range addrs {
-		apDeliver(0, addr, msg)
+		apDeliver(addr, msg)
 	}
 }
 
 func apOutbox(w http.ResponseWriter, r *http.Request) {
-	lastlink := 123456789012
-	rows, err := stmtGetLinks.Query(lastlink)
-	links, _ := readlinks(rows, err)
-
-	var jlinks []junk.Junk
-	for _, l := range links {
-		j := apCreate(l, false)
-		jlinks = append(jlinks, j)
-	}
+	outbox := serverURL + "/outbox"
+	var total int64
+	row := stmtCountLinks.QueryRow()
+	row.Scan(&total)
 
 	j := junk.New()
 	j["@context"] = apContext
-	j["id"] = serverURL + "/outbox"
-	j["type"] = "OrderedCollection"
-	j["totalItems"] = len(jlinks)
+	if r.FormValue("page") == "" {
+		j["id"] = outbox
+		j["type"] = "OrderedCollection"
+		j["totalItems"] = total
+		j["first"] = outbox + "?page=true"
+		j["last"] = outbox + "?page=true&after=0"
+		w.Header().Set("Content-Type", apBestType)
+		j.Write(w)
+		return
+	}
+
+	var links []*Link
+	before, _ := strconv.ParseInt(r.FormValue("before"), 10, 0)
+	after, err := strconv.ParseInt(r.FormValue("after"), 10, 0)
+	if err == nil {
+		rows, err := stmtLinksAfter.Query(after)
+		links, _ = readlinks(rows, err)
+		// oldest first from the query, but pages are newest first
+		for i, j := 0, len(links)-1; i < j; i, j = i+1, j-1 {
+			links[i], links[j] = links[j], links[i]
+		}
+		j["id"] = fmt.Sprintf("%s?page=true&after=%d", outbox, after)
+	} else {
+		if before > 0 {
+			j["id"] = fmt.Sprintf("%s?page=true&before=%d", outbox, before)
+		} else {
+			j["id"] = outbox + "?page=true"
+			before = 123456789012
+		}
+		rows, err := stmtGetLinks.Query(before, visPublic)
+		links, _ = readlinks(rows, err)
+	}
+
+	jlinks := []junk.Junk{}
+	for _, l := range links {
+		jlinks = append(jlinks, apCreate(l, false))
+	}
+	j["type"] = "OrderedCollectionPage"
+	j["partOf"] = outbox
+	j["totalItems"] = total
 	j["orderedItems"] = jlinks
+	if len(links) > 0 {
+		newest := links[0].ID
+		oldest := links[len(links)-1].ID
+		if more(stmtNewerLinks, newest) {
+			j["prev"] = fmt.Sprintf("%s?page=true&after=%d", outbox, newest)
+		}
+		if more(stmtOlderLinks, oldest) {
+			j["next"] = fmt.Sprintf("%s?page=true&before=%d", outbox, oldest)
+		}
+	}
 
 	w.Header().Set("Content-Type", apBestType)
 	j.Write(w)
 }
 
+func more(stmt *sql.Stmt, linkid int64) bool {
+	var cnt int64
+	row := stmt.QueryRow(linkid)
+	row.Scan(&cnt)
+	return cnt > 0
+}
+
 func ap403(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "no", http.StatusForbidden)
 }
@@ -414,7 +625,15 @@ func postMsg(url string, msg []byte) error {
 		return err
 	}
 	req.Header.Set("Content-Type", apBestType)
-	httpsig.SignRequest(serverURL+"#key", serverPrivateKey, req, msg)
+	// sign as whichever of our actors is sending
+	actor := serverURL
+	if j, err := junk.FromBytes(msg); err == nil {
+		if a, ok := j.GetString("actor"); ok {
+			actor = a
+		}
+	}
+	keyname, key := apSigningKey(actor)
+	httpsig.SignRequest(keyname, key, req, msg)
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
 	req = req.WithContext(ctx)
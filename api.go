@@ -0,0 +1,432 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func hashtoken(token string) string {
+	hasher := sha512.New512_256()
+	hasher.Write([]byte(token))
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// apiRequired checks the token and the role of its user
+func apiRequired(role string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, "need a token", http.StatusUnauthorized)
+			return
+		}
+		var userid int64
+		row := stmtGetToken.QueryRow(hashtoken(token))
+		err := row.Scan(&userid)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("error checking token: %s", err)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		u := getuserbyid(userid)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		if !u.Is(role) {
+			apiError(w, "not allowed", http.StatusForbidden)
+			return
+		}
+		handler(w, withuser(r, u))
+	})
+}
+
+func apiWrite(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	err := e.Encode(v)
+	if err != nil {
+		log.Printf("error writing json: %s", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, msg string, code int) {
+	apiWrite(w, code, map[string]string{"error": msg})
+}
+
+func apiLinkID(r *http.Request) int64 {
+	linkid, _ := strconv.ParseInt(mux.Vars(r)["linkid"], 10, 0)
+	return linkid
+}
+
+func apiListLinks(w http.ResponseWriter, r *http.Request) {
+	lastlink, _ := strconv.ParseInt(r.FormValue("before"), 10, 0)
+	if lastlink == 0 {
+		lastlink = 123456789012
+	}
+	links, lastlink := querylinks(r.FormValue("collection"), r.FormValue("tag"), r.FormValue("site"),
+		r.FormValue("source"), r.FormValue("q"), lastlink, visPrivate)
+	if links == nil {
+		links = []*Link{}
+	}
+	apiWrite(w, http.StatusOK, map[string]interface{}{
+		"links":    links,
+		"lastlink": lastlink,
+	})
+}
+
+func apiGetLink(w http.ResponseWriter, r *http.Request) {
+	link := oneLink(apiLinkID(r))
+	// queued links are only for whoever can edit them, like on the site
+	if link != nil && link.Queued() && !getuser(r).CanEdit(link) {
+		link = nil
+	}
+	if link == nil {
+		apiError(w, "no such link", http.StatusNotFound)
+		return
+	}
+	apiWrite(w, http.StatusOK, link)
+}
+
+func apiSaveLink(w http.ResponseWriter, r *http.Request) {
+	link := new(Link)
+	linkid := apiLinkID(r)
+	u := getuser(r)
+	wasPublic, wasQueued := false, false
+	if linkid > 0 {
+		link = oneLink(linkid)
+		if link == nil {
+			apiError(w, "no such link", http.StatusNotFound)
+			return
+		}
+		if !u.CanEdit(link) {
+			apiError(w, "not your link", http.StatusForbidden)
+			return
+		}
+		wasPublic = link.Federated()
+		wasQueued = link.Queued()
+	} else {
+		link.UserID = u.ID
+	}
+	// fields missing from the request keep their current values
+	err := json.NewDecoder(r.Body).Decode(link)
+	if err != nil {
+		apiError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	link.ID = linkid
+	if !validvisibility(link.Visibility) {
+		apiError(w, "unknown visibility", http.StatusBadRequest)
+		return
+	}
+	if linkid > 0 && !wasQueued {
+		link.Draft = false
+		link.PublishAt = nil
+	}
+	link.URL = strings.TrimSpace(link.URL)
+	link.Title = strings.TrimSpace(link.Title)
+	if linkid == 0 && r.FormValue("anyway") == "" {
+		if dupe := findduplicate(link.URL); dupe != nil {
+			apiWrite(w, http.StatusConflict, dupe)
+			return
+		}
+	}
+	link.PlainSummary = strings.TrimSpace(link.PlainSummary)
+	link.Source = strings.TrimSpace(link.Source)
+
+	err = storelink(link)
+	if err == errLinkIncomplete || err == errLinkRepeat {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error saving link: %s", err)
+		apiError(w, "couldn't save link", http.StatusInternalServerError)
+		return
+	}
+	go apPublish(link.ID, wasPublic)
+
+	code := http.StatusOK
+	if linkid == 0 {
+		code = http.StatusCreated
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/links/%d", link.ID))
+	}
+	apiWrite(w, code, oneLink(link.ID))
+}
+
+func apiDeleteLink(w http.ResponseWriter, r *http.Request) {
+	linkid := apiLinkID(r)
+	link := oneLink(linkid)
+	if link == nil {
+		apiError(w, "no such link", http.StatusNotFound)
+		return
+	}
+	if !getuser(r).CanEdit(link) {
+		apiError(w, "not your link", http.StatusForbidden)
+		return
+	}
+	savemtx.Lock()
+	err := zaplink(linkid)
+	savemtx.Unlock()
+	if err != nil {
+		log.Printf("error deleting link: %s", err)
+		apiError(w, "couldn't delete link", http.StatusInternalServerError)
+		return
+	}
+	if link.Federated() {
+		go apUnpublish(linkid)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListTags(w http.ResponseWriter, r *http.Request) {
+	tags := alltags(visPrivate)
+	if tags == nil {
+		tags = []Tag{}
+	}
+	apiWrite(w, http.StatusOK, tags)
+}
+
+func apiListSources(w http.ResponseWriter, r *http.Request) {
+	sources := getsources(visPrivate)
+	if sources == nil {
+		sources = []Source{}
+	}
+	apiWrite(w, http.StatusOK, sources)
+}
+
+type apiRename struct {
+	Name string `json:"name"`
+	Into string `json:"into"`
+}
+
+func apiReadRename(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var args apiRename
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		apiError(w, "bad json", http.StatusBadRequest)
+		return "", false
+	}
+	name := args.Name
+	if name == "" {
+		name = args.Into
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.IndexByte(name, ' ') != -1 {
+		apiError(w, "need a new name", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+func tagcount(tag string) int64 {
+	var cnt int64
+	row := stmtTagCount.QueryRow(tag)
+	row.Scan(&cnt)
+	return cnt
+}
+
+func apiRenameTag(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tagname"]
+	merge := strings.HasSuffix(r.URL.Path, "/merge")
+	into, ok := apiReadRename(w, r)
+	if !ok {
+		return
+	}
+	if into == tag {
+		apiError(w, "can't rename a tag into itself", http.StatusBadRequest)
+		return
+	}
+	if tagcount(tag) == 0 {
+		apiError(w, "no such tag", http.StatusNotFound)
+		return
+	}
+	if !merge && tagcount(into) > 0 {
+		apiError(w, "tag already exists, merge it instead", http.StatusConflict)
+		return
+	}
+
+	savemtx.Lock()
+	defer savemtx.Unlock()
+	db := opendatabase()
+	tx, err := db.Begin()
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteDupTags).Exec(tag, into)
+		if err == nil {
+			_, err = tx.Stmt(stmtRenameTag).Exec(into, tag)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	touchcatalog()
+	if err != nil {
+		log.Printf("error renaming tag: %s", err)
+		apiError(w, "couldn't rename tag", http.StatusInternalServerError)
+		return
+	}
+	apiWrite(w, http.StatusOK, Tag{Name: into, Count: tagcount(into)})
+}
+
+func apiRenameSource(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["sourcename"]
+	merge := strings.HasSuffix(r.URL.Path, "/merge")
+	into, ok := apiReadRename(w, r)
+	if !ok {
+		return
+	}
+	if into == name {
+		apiError(w, "can't rename a source into itself", http.StatusBadRequest)
+		return
+	}
+	var exists, found bool
+	for _, s := range getsources(visPrivate) {
+		if s.Name == name {
+			found = true
+		}
+		if s.Name == into {
+			exists = true
+		}
+	}
+	if !found {
+		apiError(w, "no such source", http.StatusNotFound)
+		return
+	}
+	if !merge && exists {
+		apiError(w, "source already exists, merge it instead", http.StatusConflict)
+		return
+	}
+
+	// the notes of the surviving source win
+	keepnotes := getsourceinfo(into) != ""
+
+	savemtx.Lock()
+	defer savemtx.Unlock()
+	db := opendatabase()
+	tx, err := db.Begin()
+	if err == nil {
+		_, err = tx.Stmt(stmtRenameLinkSource).Exec(into, name)
+		if err == nil {
+			if keepnotes {
+				_, err = tx.Stmt(stmtDeleteSource).Exec(name)
+			} else {
+				_, err = tx.Stmt(stmtDeleteSource).Exec(into)
+				if err == nil {
+					_, err = tx.Stmt(stmtRenameSource).Exec(into, name)
+				}
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	touchcatalog()
+	if err != nil {
+		log.Printf("error renaming source: %s", err)
+		apiError(w, "couldn't rename source", http.StatusInternalServerError)
+		return
+	}
+	notes := getsourceinfo(into)
+	apiWrite(w, http.StatusOK, Source{Name: into, Notes: notes, Info: htmlify(notes)})
+}
+
+func apiRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Handle("/links", apiRequired("viewer", apiListLinks)).Methods("GET")
+	api.Handle("/links", apiRequired("editor", apiSaveLink)).Methods("POST")
+	api.Handle("/links/{linkid:[0-9]+}", apiRequired("viewer", apiGetLink)).Methods("GET")
+	api.Handle("/links/{linkid:[0-9]+}", apiRequired("editor", apiSaveLink)).Methods("PUT")
+	api.Handle("/links/{linkid:[0-9]+}", apiRequired("editor", apiDeleteLink)).Methods("DELETE")
+	api.Handle("/tags", apiRequired("viewer", apiListTags)).Methods("GET")
+	api.Handle("/tags/{tagname:[[:alnum:].-]+}/rename", apiRequired("admin", apiRenameTag)).Methods("POST")
+	api.Handle("/tags/{tagname:[[:alnum:].-]+}/merge", apiRequired("admin", apiRenameTag)).Methods("POST")
+	api.Handle("/sources", apiRequired("viewer", apiListSources)).Methods("GET")
+	api.Handle("/sources/{sourcename:[[:alnum:].-]+}/rename", apiRequired("admin", apiRenameSource)).Methods("POST")
+	api.Handle("/sources/{sourcename:[[:alnum:].-]+}/merge", apiRequired("admin", apiRenameSource)).Methods("POST")
+}
+
+func tokencmd(args []string) {
+	db := opendatabase()
+	if len(args) < 1 {
+		log.Fatal("need an argument: token (add|list|revoke)")
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			log.Fatal("need an argument: token add username [name]")
+		}
+		var userid int64
+		row := db.QueryRow("select userid from users where username = ?", args[1])
+		err := row.Scan(&userid)
+		if err != nil {
+			log.Fatalf("no such user: %s", args[1])
+		}
+		name := strings.Join(args[2:], " ")
+		var randbytes [24]byte
+		rand.Read(randbytes[:])
+		token := fmt.Sprintf("%x", randbytes)
+		dt := time.Now().UTC().Format(dbtimeformat)
+		doordie(db, "insert into apitokens (userid, name, hash, dt) values (?, ?, ?, ?)",
+			userid, name, hashtoken(token), dt)
+		fmt.Printf("%s\n", token)
+	case "list":
+		rows, err := db.Query("select tokenid, username, name, dt from apitokens join users on apitokens.userid = users.userid order by tokenid")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tokenid int64
+			var username, name, dt string
+			err = rows.Scan(&tokenid, &username, &name, &dt)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", tokenid, username, dt, name)
+		}
+	case "revoke":
+		if len(args) != 2 {
+			log.Fatal("need an argument: token revoke tokenid")
+		}
+		tokenid, _ := strconv.ParseInt(args[1], 10, 0)
+		doordie(db, "delete from apitokens where tokenid = ?", tokenid)
+	default:
+		log.Fatal("argument must be add, list, or revoke")
+	}
+}
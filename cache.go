@@ -0,0 +1,206 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// Public pages only change when the catalog does, so anonymous requests
+// get served from memory until the next save or delete.
+
+type cachedpage struct {
+	code   int
+	header http.Header
+	body   []byte
+	etag   string
+	when   time.Time
+}
+
+var pagecache = make(map[string]*cachedpage)
+var pagelock sync.Mutex
+var newestlink int64
+var lastedit time.Time
+
+// changes made by other processes, like import, show up after this long
+var pageCacheTime = 5 * time.Minute
+var pageCacheMax = 1000
+
+func loadcatalogstate() {
+	var dt string
+	getconfig("lastedit", &dt)
+	t, _ := time.Parse(dbtimeformat, dt)
+	row := stmtNewestLink.QueryRow()
+	var linkid int64
+	var posted string
+	row.Scan(&linkid, &posted)
+	p, _ := time.Parse(dbtimeformat, posted)
+	if p.After(t) {
+		t = p
+	}
+	pagelock.Lock()
+	newestlink = linkid
+	lastedit = t
+	pagelock.Unlock()
+}
+
+// touchcatalog is called after every change to links or sources
+func touchcatalog() {
+	now := time.Now().UTC()
+	setconfig("lastedit", now.Format(dbtimeformat))
+	loadcatalogstate()
+	pagelock.Lock()
+	lastedit = now
+	pagecache = make(map[string]*cachedpage)
+	pagelock.Unlock()
+}
+
+// forgetlink drops the cached permalink page of a link, for changes
+// like reactions that don't show anywhere else
+func forgetlink(linkid int64) {
+	path := fmt.Sprintf("/l/%d", linkid)
+	pagelock.Lock()
+	for _, activity := range []bool{false, true} {
+		delete(pagecache, fmt.Sprintf("%v %s", activity, path))
+	}
+	pagelock.Unlock()
+}
+
+func catalogetag(activity bool) (string, time.Time) {
+	pagelock.Lock()
+	defer pagelock.Unlock()
+	kind := "h"
+	if activity {
+		kind = "a"
+	}
+	return fmt.Sprintf(`"%d-%x-%s"`, newestlink, lastedit.UnixNano(), kind), lastedit
+}
+
+type pagerecorder struct {
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *pagerecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *pagerecorder) Write(data []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	return rec.body.Write(data)
+}
+
+func (rec *pagerecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+func notmodified(r *http.Request, etag string, modtime time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, m := range strings.Split(match, ",") {
+			m = strings.TrimPrefix(strings.TrimSpace(m), "W/")
+			if m == etag || m == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modtime.Truncate(time.Second).After(since)
+}
+
+func servecached(w http.ResponseWriter, r *http.Request, page *cachedpage, modtime time.Time) {
+	h := w.Header()
+	for k, v := range page.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Add("Vary", "Accept")
+	if page.code != http.StatusOK {
+		w.WriteHeader(page.code)
+		w.Write(page.body)
+		return
+	}
+	h.Set("ETag", page.etag)
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		modtime = t
+	} else if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if notmodified(r, page.etag, modtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(page.code)
+	w.Write(page.body)
+}
+
+// cachepage wraps a handler for a public page
+func cachepage(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if login.GetUserInfo(r) != nil || strings.HasPrefix(r.URL.Path, "/random") {
+			handler(w, r)
+			return
+		}
+		activity := isActivity(r.Header.Get("Accept"))
+		etag, modtime := catalogetag(activity)
+		key := fmt.Sprintf("%v %s", activity, r.URL.RequestURI())
+
+		pagelock.Lock()
+		page := pagecache[key]
+		pagelock.Unlock()
+		if page != nil && page.etag == etag && time.Since(page.when) < pageCacheTime {
+			servecached(w, r, page, modtime)
+			return
+		}
+
+		// the conditional bits are handled here, so ask for the full page
+		r2 := r.Clone(r.Context())
+		r2.Header.Del("If-None-Match")
+		r2.Header.Del("If-Modified-Since")
+		rec := &pagerecorder{header: make(http.Header)}
+		handler(rec, r2)
+		page = &cachedpage{
+			code:   rec.code,
+			header: rec.header,
+			body:   rec.body.Bytes(),
+			etag:   etag,
+			when:   time.Now(),
+		}
+		if page.code == 0 {
+			page.code = http.StatusOK
+		}
+		if page.code == http.StatusOK {
+			pagelock.Lock()
+			if len(pagecache) >= pageCacheMax {
+				pagecache = make(map[string]*cachedpage)
+			}
+			pagecache[key] = page
+			pagelock.Unlock()
+		}
+		servecached(w, r, page, modtime)
+	}
+}
@@ -0,0 +1,209 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// query parameters that only say how somebody got to a page
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "msclkid": true,
+	"igshid": true, "mc_cid": true, "mc_eid": true, "_hsenc": true,
+	"_hsmi": true, "ref_src": true, "ref_url": true, "yclid": true,
+}
+
+var trackingPrefixes = []string{"utm_", "pk_", "hmb_"}
+
+// sites known to serve the same pages from mobile and amp addresses,
+// like en.m.wikipedia.org or amp.theguardian.com/x/amp
+var mirrorSites = []string{
+	"bbc.co.uk", "bbc.com", "cnn.com", "facebook.com", "nytimes.com",
+	"theguardian.com", "twitter.com", "washingtonpost.com",
+	"wikipedia.org", "wiktionary.org", "youtube.com",
+}
+
+var mirrorLabels = map[string]bool{"m": true, "mobile": true, "amp": true}
+
+// query parameters that ask a mirror site for its amp page
+var ampParams = map[string]bool{"amp": true, "outputtype": true}
+
+func mirrorsite(host string) string {
+	for _, site := range mirrorSites {
+		if host == site || strings.HasSuffix(host, "."+site) {
+			return site
+		}
+	}
+	return ""
+}
+
+func istracking(name string) bool {
+	name = strings.ToLower(name)
+	if trackingParams[name] {
+		return true
+	}
+	for _, p := range trackingPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalurl reduces a url to the form used to spot duplicates.
+// It's for comparing, the saved url is left as given.
+func canonicalurl(s string) string {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(s)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	u.User = nil
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "80" || port == "443" {
+		port = ""
+	}
+	host = strings.TrimSuffix(host, ".")
+	// amp pages only come off the known mirrors and the amp cache
+	amp := false
+	if strings.HasSuffix(host, ".ampproject.org") && strings.HasPrefix(u.Path, "/c/") {
+		// cdn.ampproject.org/c/s/example.com/page
+		p := strings.TrimPrefix(u.Path, "/c/")
+		p = strings.TrimPrefix(p, "s/")
+		if i := strings.IndexByte(p, '/'); i > 0 {
+			host, u.Path = strings.ToLower(p[:i]), p[i:]
+			u.RawPath = ""
+			amp = true
+		}
+	}
+	if strings.HasPrefix(host, "www.") && strings.Count(host, ".") > 1 {
+		host = host[4:]
+	}
+	if site := mirrorsite(host); site != "" {
+		var labels []string
+		for _, l := range strings.Split(strings.TrimSuffix(host, site), ".") {
+			if l != "" && !mirrorLabels[l] {
+				labels = append(labels, l)
+			}
+		}
+		host = strings.Join(append(labels, site), ".")
+		amp = true
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.IndexByte(host, ':') != -1 {
+		// ipv6 keeps its brackets
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	u.Fragment = ""
+
+	path := u.EscapedPath()
+	if amp {
+		path = strings.TrimSuffix(path, "/")
+		path = strings.TrimSuffix(path, "/amp")
+		path = strings.TrimSuffix(path, "/amp.html")
+	}
+	path = strings.TrimSuffix(path, "/")
+	u.RawPath = ""
+	u.Path, _ = url.PathUnescape(path)
+
+	var keep []string
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		name := kv
+		if i := strings.IndexByte(kv, '='); i != -1 {
+			name = kv[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if istracking(name) || amp && ampParams[strings.ToLower(name)] {
+			continue
+		}
+		keep = append(keep, kv)
+	}
+	sort.Strings(keep)
+	u.RawQuery = strings.Join(keep, "&")
+	u.ForceQuery = false
+	return u.String()
+}
+
+// findduplicate looks for a link already saved under the same canonical url
+func findduplicate(s string) *Link {
+	linkid := findurl(s)
+	if linkid == 0 {
+		return nil
+	}
+	return oneLink(linkid)
+}
+
+func fillcanonical(db *sql.DB) {
+	rows, err := db.Query("select linkid, url from links")
+	if err != nil {
+		log.Fatal(err)
+	}
+	canon := make(map[int64]string)
+	for rows.Next() {
+		var linkid int64
+		var url string
+		err = rows.Scan(&linkid, &url)
+		if err != nil {
+			log.Fatalf("can't scan link: %s", err)
+		}
+		canon[linkid] = canonicalurl(url)
+	}
+	rows.Close()
+	for linkid, c := range canon {
+		doordie(db, "update links set canonical = ? where linkid = ?", c, linkid)
+	}
+}
+
+func dedupe() {
+	db := opendatabase()
+	rows, err := db.Query("select canonical, linkid, url, dt from links where canonical in (select canonical from links group by canonical having count(*) > 1) order by canonical, linkid")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	last := ""
+	for rows.Next() {
+		var canon, url, dt string
+		var linkid int64
+		err = rows.Scan(&canon, &linkid, &url, &dt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if canon != last {
+			fmt.Printf("%s\n", canon)
+			last = canon
+		}
+		fmt.Printf("\t%d\t%s\t%s\n", linkid, dt, url)
+	}
+}
@@ -0,0 +1,313 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"humungus.tedunangst.com/r/webs/junk"
+)
+
+// A collection is a curated stream of links with its own actor, which
+// announces the links added to it. Collection 0 is the whole catalog.
+
+type Collection struct {
+	ID    int64
+	Name  string
+	Title string
+}
+
+var allCollections int64 = -1
+
+var re_collectionname = regexp.MustCompile(`^[[:alnum:]-]+$`)
+
+func (c *Collection) URL() string {
+	if c == nil {
+		return serverURL
+	}
+	return serverURL + "/c/" + c.Name
+}
+
+func getcollections() []*Collection {
+	rows, err := stmtGetCollections.Query()
+	if err != nil {
+		log.Printf("error getting collections: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var collections []*Collection
+	for rows.Next() {
+		c := new(Collection)
+		err = rows.Scan(&c.ID, &c.Name, &c.Title)
+		if err != nil {
+			log.Printf("error scanning collection: %s", err)
+			continue
+		}
+		collections = append(collections, c)
+	}
+	return collections
+}
+
+func getcollection(name string) *Collection {
+	c := new(Collection)
+	row := stmtGetCollection.QueryRow(name)
+	err := row.Scan(&c.ID, &c.Name, &c.Title)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// actorcollection finds which of our actors a url is
+func actorcollection(actor string) (int64, bool) {
+	if actor == serverURL {
+		return 0, true
+	}
+	prefix := serverURL + "/c/"
+	if !strings.HasPrefix(actor, prefix) {
+		return 0, false
+	}
+	c := getcollection(actor[len(prefix):])
+	if c == nil {
+		return 0, false
+	}
+	return c.ID, true
+}
+
+func collectionlinks(links []*Link) {
+	if len(links) == 0 {
+		return
+	}
+	db := opendatabase()
+	var ids []string
+	lmap := make(map[int64]*Link)
+	for _, l := range links {
+		ids = append(ids, fmt.Sprintf("%d", l.ID))
+		lmap[l.ID] = l
+	}
+	q := fmt.Sprintf("select linkid, name from linkcollections join collections on linkcollections.collectionid = collections.collectionid where linkid in (%s) order by name", strings.Join(ids, ","))
+	rows, err := db.Query(q)
+	if err != nil {
+		log.Printf("can't load collections: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lid int64
+		var name string
+		err = rows.Scan(&lid, &name)
+		if err != nil {
+			log.Printf("can't scan collection: %s", err)
+			continue
+		}
+		l := lmap[lid]
+		l.Collections = append(l.Collections, name)
+	}
+}
+
+// savelinkcollections keeps existing memberships so they aren't announced twice
+func savelinkcollections(link *Link) {
+	want := make(map[int64]bool)
+	for _, name := range link.Collections {
+		c := getcollection(name)
+		if c == nil {
+			continue
+		}
+		want[c.ID] = true
+	}
+	rows, err := stmtLinkCollections.Query(link.ID)
+	if err != nil {
+		log.Printf("error getting link collections: %s", err)
+		return
+	}
+	have := make(map[int64]bool)
+	for rows.Next() {
+		var cid int64
+		rows.Scan(&cid)
+		have[cid] = true
+	}
+	rows.Close()
+	for cid := range have {
+		if !want[cid] {
+			stmtDeleteLinkCollection.Exec(link.ID, cid)
+		}
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	for cid := range want {
+		if !have[cid] {
+			stmtSaveLinkCollection.Exec(link.ID, cid, dt)
+		}
+	}
+}
+
+func apAnnounce(c *Collection, link *Link, dt string) junk.Junk {
+	j := junk.New()
+	j["actor"] = c.URL()
+	j["id"] = fmt.Sprintf("%s/announce/%d", c.URL(), link.ID)
+	j["type"] = "Announce"
+	j["object"] = fmt.Sprintf("%s/l/%d", serverURL, link.ID)
+	if t, err := time.Parse(dbtimeformat, dt); err == nil {
+		j["published"] = t.Format(time.RFC3339)
+	}
+	j["to"] = apPublic
+	j["cc"] = []string{c.URL() + "/followers", serverURL}
+	return j
+}
+
+// apAnnounceNew has each collection announce links newly added to it
+func apAnnounceNew(link *Link) {
+	rows, err := stmtUnannounced.Query(link.ID)
+	if err != nil {
+		log.Printf("error getting announcements: %s", err)
+		return
+	}
+	type todo struct {
+		c  *Collection
+		dt string
+	}
+	var todos []todo
+	for rows.Next() {
+		c := new(Collection)
+		var dt string
+		rows.Scan(&c.ID, &c.Name, &c.Title, &dt)
+		todos = append(todos, todo{c, dt})
+	}
+	rows.Close()
+	if !link.Federated() {
+		return
+	}
+	for _, t := range todos {
+		stmtSetAnnounced.Exec(link.ID, t.c.ID)
+		apBroadcast(apAnnounce(t.c, link, t.dt), t.c.ID)
+	}
+}
+
+func apCollectionOutbox(w http.ResponseWriter, r *http.Request, c *Collection) {
+	outbox := c.URL() + "/outbox"
+	var total int64
+	row := stmtCountCollectionLinks.QueryRow(c.ID)
+	row.Scan(&total)
+
+	j := junk.New()
+	j["@context"] = apContext
+	if r.FormValue("page") == "" {
+		j["id"] = outbox
+		j["type"] = "OrderedCollection"
+		j["totalItems"] = total
+		j["first"] = outbox + "?page=true"
+		w.Header().Set("Content-Type", apBestType)
+		j.Write(w)
+		return
+	}
+	before, _ := strconv.ParseInt(r.FormValue("before"), 10, 0)
+	if before > 0 {
+		j["id"] = fmt.Sprintf("%s?page=true&before=%d", outbox, before)
+	} else {
+		j["id"] = outbox + "?page=true"
+		before = 123456789012
+	}
+	rows, err := stmtCollectionLinks.Query(c.ID, before, visPublic)
+	links, last := readlinks(rows, err)
+	items := []junk.Junk{}
+	for _, link := range links {
+		items = append(items, apAnnounce(c, link, link.Posted.Format(dbtimeformat)))
+	}
+	j["type"] = "OrderedCollectionPage"
+	j["partOf"] = outbox
+	j["totalItems"] = total
+	j["orderedItems"] = items
+	if len(links) == 20 {
+		j["next"] = fmt.Sprintf("%s?page=true&before=%d", outbox, last)
+	}
+	w.Header().Set("Content-Type", apBestType)
+	j.Write(w)
+}
+
+// apCollectionHandle serves the actor and collections under /c/name
+func apCollectionHandle(w http.ResponseWriter, r *http.Request) {
+	c := getcollection(mux.Vars(r)["collection"])
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch mux.Vars(r)["what"] {
+	case "outbox":
+		apCollectionOutbox(w, r, c)
+	case "followers":
+		apFollowersOf(w, r, c)
+	case "following":
+		apCollection(w, r, c.URL()+"/following", 0, func(before int64) ([]string, int64) {
+			return nil, 0
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func collectioncmd(args []string) {
+	db := opendatabase()
+	prepareStatements(db)
+	if len(args) < 1 {
+		log.Fatal("need an argument: collection (add|list|remove)")
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			log.Fatal("need an argument: collection add name [title]")
+		}
+		name := strings.ToLower(args[1])
+		if !re_collectionname.MatchString(name) || name == "inks" {
+			log.Fatalf("bad collection name: %s", name)
+		}
+		if getcollection(name) != nil {
+			log.Fatalf("collection %s already exists", name)
+		}
+		title := strings.Join(args[2:], " ")
+		if title == "" {
+			title = name
+		}
+		dt := time.Now().UTC().Format(dbtimeformat)
+		doordie(db, "insert into collections (name, title, dt) values (?, ?, ?)", name, title, dt)
+	case "list":
+		for _, c := range getcollections() {
+			var cnt int64
+			stmtCountCollectionLinks.QueryRow(c.ID).Scan(&cnt)
+			fmt.Printf("%s\t%d\t%s\n", c.Name, cnt, c.Title)
+		}
+	case "remove":
+		if len(args) != 2 {
+			log.Fatal("need an argument: collection remove name")
+		}
+		c := getcollection(args[1])
+		if c == nil {
+			log.Fatalf("no collection %s", args[1])
+		}
+		doordie(db, "delete from linkcollections where collectionid = ?", c.ID)
+		doordie(db, "delete from followers where collectionid = ?", c.ID)
+		doordie(db, "delete from pending where collectionid = ?", c.ID)
+		doordie(db, "delete from collections where collectionid = ?", c.ID)
+	default:
+		log.Fatal("argument must be add, list, or remove")
+	}
+	touchcatalog()
+}
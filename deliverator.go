@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outgoing activities are saved in the deliveries table and sent by a
+// small pool of workers, so nothing is lost across restarts.
+
+var deliveryWorkers = 4
+var deliveryPerHost = 2
+var deliveryPoll = time.Minute
+var deliveryMinBackoff = 2 * time.Minute
+var deliveryMaxBackoff = 12 * time.Hour
+
+// an inbox that has failed for this long is given up on
+var deadInboxWindow = 7 * 24 * time.Hour
+
+var deliverynudge = make(chan bool, 1)
+
+type delivery struct {
+	dlid  int64
+	rcpt  string
+	msg   []byte
+	tries int
+}
+
+func nudgedeliverator() {
+	select {
+	case deliverynudge <- true:
+	default:
+	}
+}
+
+func apDeliver(rcpt string, msg []byte) {
+	if deadinbox(rcpt) {
+		log.Printf("not delivering to dead inbox %s", rcpt)
+		return
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	_, err := stmtSaveDelivery.Exec(rcpt, inboxhost(rcpt), msg, dt, dt)
+	if err != nil {
+		log.Printf("error saving delivery to %s: %s", rcpt, err)
+		return
+	}
+	nudgedeliverator()
+}
+
+func deadinbox(rcpt string) bool {
+	var firstfail string
+	var dead int
+	row := stmtGetInbox.QueryRow(rcpt)
+	row.Scan(&firstfail, &dead)
+	return dead != 0
+}
+
+// backoff doubles with every try, with some jitter so that a pile of
+// failures doesn't all come back at once.
+func backoff(tries int) time.Duration {
+	if tries > 20 {
+		tries = 20
+	}
+	d := deliveryMinBackoff << uint(tries-1)
+	if d > deliveryMaxBackoff || d <= 0 {
+		d = deliveryMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func inboxhost(rcpt string) string {
+	u, err := url.Parse(rcpt)
+	if err != nil {
+		return rcpt
+	}
+	return u.Host
+}
+
+// duedeliveries takes only a few from each host, so a busy one can't
+// crowd out the rest
+func duedeliveries() []*delivery {
+	now := time.Now().UTC().Format(dbtimeformat)
+	rows, err := stmtDueDeliveries.Query(now, deliveryPerHost)
+	if err != nil {
+		log.Printf("error getting deliveries: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var dels []*delivery
+	for rows.Next() {
+		d := new(delivery)
+		err = rows.Scan(&d.dlid, &d.rcpt, &d.msg, &d.tries)
+		if err != nil {
+			log.Printf("error scanning delivery: %s", err)
+			continue
+		}
+		dels = append(dels, d)
+	}
+	return dels
+}
+
+func deliverone(d *delivery) {
+	if isblocked(d.rcpt) {
+		stmtDeleteDelivery.Exec(d.dlid)
+		return
+	}
+	err := postMsg(d.rcpt, d.msg)
+	if err == nil {
+		stmtDeleteDelivery.Exec(d.dlid)
+		stmtInboxOK.Exec(d.rcpt)
+		return
+	}
+	log.Printf("error posting to %s: %s", d.rcpt, err)
+	now := time.Now().UTC()
+	stmtInboxFailed.Exec(d.rcpt, now.Format(dbtimeformat))
+	var dt string
+	var dead int
+	row := stmtGetInbox.QueryRow(d.rcpt)
+	row.Scan(&dt, &dead)
+	firstfail, _ := time.Parse(dbtimeformat, dt)
+	if !now.Before(firstfail.Add(deadInboxWindow)) {
+		log.Printf("giving up on %s, failing since %s", d.rcpt, dt)
+		stmtInboxDead.Exec(d.rcpt)
+		stmtPurgeInbox.Exec(d.rcpt)
+		return
+	}
+	d.tries++
+	next := now.Add(backoff(d.tries))
+	stmtRetryDelivery.Exec(d.tries, next.Format(dbtimeformat), err.Error(), d.dlid)
+}
+
+func deliverator() {
+	var days int
+	getconfig("deadinbox", &days)
+	if days > 0 {
+		deadInboxWindow = time.Duration(days) * 24 * time.Hour
+	}
+
+	sem := make(chan bool, deliveryWorkers)
+	var mtx sync.Mutex
+	busy := make(map[int64]bool)
+	hosts := make(map[string]int)
+	for {
+		for _, d := range duedeliveries() {
+			host := inboxhost(d.rcpt)
+			mtx.Lock()
+			if busy[d.dlid] || hosts[host] >= deliveryPerHost {
+				mtx.Unlock()
+				continue
+			}
+			busy[d.dlid] = true
+			hosts[host]++
+			mtx.Unlock()
+			sem <- true
+			go func(d *delivery, host string) {
+				deliverone(d)
+				mtx.Lock()
+				delete(busy, d.dlid)
+				hosts[host]--
+				mtx.Unlock()
+				<-sem
+				nudgedeliverator()
+			}(d, host)
+		}
+		select {
+		case <-deliverynudge:
+		case <-time.After(deliveryPoll):
+		}
+	}
+}
+
+func deliveriescmd(args []string) {
+	db := opendatabase()
+	if len(args) < 1 {
+		log.Fatal("need an argument: deliveries (list|retry|purge|window)")
+	}
+	now := time.Now().UTC().Format(dbtimeformat)
+	switch args[0] {
+	case "list":
+		rows, err := db.Query("select dlid, rcpt, tries, dt, nextdt, lasterr from deliveries order by dlid")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var dlid int64
+			var tries int
+			var rcpt, dt, nextdt, lasterr string
+			err = rows.Scan(&dlid, &rcpt, &tries, &dt, &nextdt, &lasterr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%d\t%s\t%d\t%s\t%s\t%s\n", dlid, rcpt, tries, dt, nextdt, lasterr)
+		}
+		rows.Close()
+		rows, err = db.Query("select rcpt, firstfail, dead from inboxes order by rcpt")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rcpt, firstfail string
+			var dead int
+			err = rows.Scan(&rcpt, &firstfail, &dead)
+			if err != nil {
+				log.Fatal(err)
+			}
+			state := "failing"
+			if dead != 0 {
+				state = "dead"
+			}
+			fmt.Printf("%s\t%s since %s\n", rcpt, state, firstfail)
+		}
+	case "retry":
+		if len(args) == 1 || args[1] == "all" {
+			doordie(db, "update deliveries set nextdt = ?", now)
+		} else if dlid, err := strconv.ParseInt(args[1], 10, 0); err == nil {
+			doordie(db, "update deliveries set nextdt = ? where dlid = ?", now, dlid)
+		} else {
+			// a second chance for an inbox
+			doordie(db, "delete from inboxes where rcpt = ?", args[1])
+			doordie(db, "update deliveries set nextdt = ? where rcpt = ?", now, args[1])
+		}
+	case "purge":
+		if len(args) != 2 {
+			log.Fatal("need an argument: deliveries purge (all|dlid|inbox)")
+		}
+		if args[1] == "all" {
+			doordie(db, "delete from deliveries")
+		} else if dlid, err := strconv.ParseInt(args[1], 10, 0); err == nil {
+			doordie(db, "delete from deliveries where dlid = ?", dlid)
+		} else if strings.HasPrefix(args[1], "http") {
+			doordie(db, "delete from deliveries where rcpt = ?", args[1])
+		} else {
+			log.Fatal("need an argument: deliveries purge (all|dlid|inbox)")
+		}
+	case "window":
+		if len(args) != 2 {
+			log.Fatal("need an argument: deliveries window days")
+		}
+		days, err := strconv.Atoi(args[1])
+		if err != nil || days < 1 {
+			log.Fatal("window must be a number of days")
+		}
+		setconfig("deadinbox", days)
+	default:
+		log.Fatal("argument must be list, retry, purge, or window")
+	}
+}
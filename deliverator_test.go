@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testdb makes a fresh database from schema.sql and prepares statements
+func testdb(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "inks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbname = filepath.Join(dir, "inks.db")
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadsql(t, db, "schema.sql")
+	db.Close()
+	alreadyopendb = nil
+	prepareStatements(opendatabase())
+	return func() {
+		alreadyopendb.Close()
+		alreadyopendb = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func testkey(t *testing.T) {
+	serverURL = "https://inks.example"
+	pubkey, seckey, err := generatekeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setconfig("pubkey", pubkey)
+	setconfig("seckey", seckey)
+	serverKeyName = ""
+	apLoadKeys()
+}
+
+// an inbox that fails the first so many posts
+type testinbox struct {
+	sync.Mutex
+	fails int
+	posts int
+}
+
+func (box *testinbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	box.Lock()
+	defer box.Unlock()
+	box.posts++
+	if box.posts <= box.fails {
+		http.Error(w, "go away", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestBackoff(t *testing.T) {
+	for tries := 1; tries < 40; tries++ {
+		want := deliveryMaxBackoff
+		if tries < 20 && deliveryMinBackoff<<uint(tries-1) < want {
+			want = deliveryMinBackoff << uint(tries-1)
+		}
+		d := backoff(tries)
+		if d < want/2 || d > want {
+			t.Errorf("backoff(%d) = %s, wanted between %s and %s", tries, d, want/2, want)
+		}
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	defer testdb(t)()
+	testkey(t)
+	box := &testinbox{fails: 2}
+	srv := httptest.NewServer(box)
+	defer srv.Close()
+
+	rcpt := srv.URL + "/inbox"
+	apDeliver(rcpt, []byte(`{"type":"Create"}`))
+	for i := 1; i <= 2; i++ {
+		dels := duedeliveries()
+		if len(dels) != 1 {
+			t.Fatalf("try %d: %d deliveries due", i, len(dels))
+		}
+		deliverone(dels[0])
+		var tries int
+		var nextdt, lasterr string
+		row := alreadyopendb.QueryRow("select tries, nextdt, lasterr from deliveries")
+		err := row.Scan(&tries, &nextdt, &lasterr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tries != i || !strings.Contains(lasterr, "500") {
+			t.Errorf("try %d: tries %d lasterr %q", i, tries, lasterr)
+		}
+		if len(duedeliveries()) != 0 {
+			t.Errorf("try %d: retry due immediately, at %s", i, nextdt)
+		}
+		if deadinbox(rcpt) {
+			t.Errorf("try %d: inbox dead too soon", i)
+		}
+		// skip ahead
+		alreadyopendb.Exec("update deliveries set nextdt = ''")
+	}
+	dels := duedeliveries()
+	if len(dels) != 1 {
+		t.Fatalf("%d deliveries due", len(dels))
+	}
+	deliverone(dels[0])
+	if box.posts != 3 {
+		t.Errorf("inbox got %d posts", box.posts)
+	}
+	var cnt int
+	alreadyopendb.QueryRow("select count(*) from deliveries").Scan(&cnt)
+	if cnt != 0 {
+		t.Errorf("%d deliveries left after success", cnt)
+	}
+	alreadyopendb.QueryRow("select count(*) from inboxes").Scan(&cnt)
+	if cnt != 0 {
+		t.Errorf("inbox still failing after success")
+	}
+}
+
+func TestDeadInbox(t *testing.T) {
+	defer testdb(t)()
+	testkey(t)
+	box := &testinbox{fails: 1000}
+	srv := httptest.NewServer(box)
+	defer srv.Close()
+	defer func(d time.Duration) { deadInboxWindow = d }(deadInboxWindow)
+
+	rcpt := srv.URL + "/inbox"
+	apDeliver(rcpt, []byte(`{"type":"Create"}`))
+	apDeliver(rcpt, []byte(`{"type":"Delete"}`))
+	dels := duedeliveries()
+	if len(dels) != 2 {
+		t.Fatalf("%d deliveries due", len(dels))
+	}
+	deliverone(dels[0])
+	if deadinbox(rcpt) {
+		t.Fatal("inbox dead after one failure")
+	}
+
+	deadInboxWindow = 0
+	deliverone(dels[1])
+	if !deadinbox(rcpt) {
+		t.Fatal("inbox not dead")
+	}
+	var cnt int
+	alreadyopendb.QueryRow("select count(*) from deliveries").Scan(&cnt)
+	if cnt != 0 {
+		t.Errorf("%d deliveries left for dead inbox", cnt)
+	}
+	apDeliver(rcpt, []byte(`{"type":"Create"}`))
+	alreadyopendb.QueryRow("select count(*) from deliveries").Scan(&cnt)
+	if cnt != 0 {
+		t.Errorf("delivery queued for dead inbox")
+	}
+	if box.posts != 2 {
+		t.Errorf("inbox got %d posts", box.posts)
+	}
+}
+
+func TestDeliveryHosts(t *testing.T) {
+	defer testdb(t)()
+	for i := 0; i < 150; i++ {
+		apDeliver("https://busy.example/inbox", []byte(`{"type":"Create"}`))
+	}
+	apDeliver("https://quiet.example/inbox", []byte(`{"type":"Create"}`))
+	hosts := make(map[string]int)
+	for _, d := range duedeliveries() {
+		hosts[inboxhost(d.rcpt)]++
+	}
+	if hosts["busy.example"] != deliveryPerHost || hosts["quiet.example"] != 1 {
+		t.Errorf("due deliveries by host: %v", hosts)
+	}
+}
@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var exportFormats = map[string]string{
+	"json":     "jsonl",
+	"netscape": "html",
+	"markdown": "md",
+}
+
+// eachlink calls fn for every link, newest first, queued ones included
+func eachlink(fn func(*Link) error) error {
+	lastlink := int64(123456789012)
+	for {
+		rows, err := stmtGetLinks.Query(lastlink, visQueued)
+		var links []*Link
+		links, lastlink = readlinks(rows, err)
+		if len(links) == 0 {
+			return nil
+		}
+		for _, link := range links {
+			err := fn(link)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func exportlinks(w io.Writer, format string) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case "json":
+		err = exportJSON(bw)
+	case "netscape":
+		err = exportNetscape(bw)
+	case "markdown":
+		err = exportMarkdown(bw)
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func exportJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	return eachlink(func(link *Link) error {
+		return e.Encode(link)
+	})
+}
+
+func exportNetscape(w io.Writer) error {
+	io.WriteString(w, "<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	io.WriteString(w, `<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">`+"\n")
+	fmt.Fprintf(w, "<TITLE>%s</TITLE>\n<H1>%s</H1>\n<DL><p>\n", html.EscapeString(serverName), html.EscapeString(serverName))
+	err := eachlink(func(link *Link) error {
+		private := 0
+		if visibility(link.Visibility) == visPrivate {
+			private = 1
+		}
+		_, err := fmt.Fprintf(w, `<DT><A HREF="%s" ADD_DATE="%d" PRIVATE="%d" TAGS="%s">%s</A>`+"\n",
+			html.EscapeString(link.URL), link.Posted.Unix(), private,
+			html.EscapeString(strings.Join(link.Tags, ",")), html.EscapeString(link.Title))
+		if err == nil && link.PlainSummary != "" {
+			_, err = fmt.Fprintf(w, "<DD>%s\n", html.EscapeString(link.PlainSummary))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "</DL><p>\n")
+	return err
+}
+
+var mdEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `*`, `\*`, `_`, `\_`, "`", "\\`")
+
+func exportMarkdown(w io.Writer) error {
+	fmt.Fprintf(w, "# %s\n", serverName)
+	month := ""
+	return eachlink(func(link *Link) error {
+		if m := link.Posted.Format("2006-01"); m != month {
+			month = m
+			fmt.Fprintf(w, "\n## %s\n", month)
+		}
+		fmt.Fprintf(w, "\n### [%s](<%s>)\n\n", mdEscaper.Replace(link.Title), link.URL)
+		fmt.Fprintf(w, "%s · %s", link.Posted.Format("2006-01-02"), link.Site)
+		if len(link.Tags) > 0 {
+			fmt.Fprintf(w, " · tags: %s", strings.Join(link.Tags, " "))
+		}
+		if link.Source != "" {
+			fmt.Fprintf(w, " · source: %s", link.Source)
+		}
+		io.WriteString(w, "\n")
+		if link.PlainSummary != "" {
+			_, err := fmt.Fprintf(w, "\n%s\n", strings.Replace(link.PlainSummary, "\r", "", -1))
+			return err
+		}
+		return nil
+	})
+}
+
+func exportcmd(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("need arguments: export (json|netscape|markdown) [file]")
+	}
+	db := opendatabase()
+	prepareStatements(db)
+	getconfig("servername", &serverName)
+
+	w := os.Stdout
+	if len(args) == 2 {
+		fd, err := os.Create(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		w = fd
+	}
+	err := exportlinks(w, args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serveexport(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	ext, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	filename := fmt.Sprintf("inks-%s.%s", time.Now().UTC().Format("20060102"), ext)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	case "netscape":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	}
+	err := exportlinks(w, format)
+	if err != nil {
+		log.Printf("error exporting: %s", err)
+	}
+}
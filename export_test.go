@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func exportedlinks(t *testing.T) map[string]*Link {
+	links := make(map[string]*Link)
+	err := eachlink(func(link *Link) error {
+		links[link.URL] = link
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return links
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	cleanup := testdb(t)
+	later := time.Now().UTC().Add(48 * time.Hour).Truncate(time.Second)
+	for _, link := range []*Link{
+		{URL: "https://lwn.net/Articles/1/", Title: "The kernel", PlainSummary: "what's new",
+			Tags: []string{"kernel", "linux"}, Source: "lwn",
+			Posted: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/secret", Title: "Secret", Visibility: "private",
+			Posted: time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/unlisted", Title: "Unlisted", Visibility: "unlisted",
+			Tags: []string{"misc"}, Posted: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/draft", Title: "Draft", Draft: true},
+		{URL: "https://example.com/later", Title: "Later", PublishAt: &later},
+	} {
+		err := storelink(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := exportedlinks(t)
+	if len(want) != 5 {
+		t.Fatalf("exported %d links", len(want))
+	}
+	var buf bytes.Buffer
+	err := exportlinks(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	defer testdb(t)()
+	links, err := importJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != len(want) {
+		t.Fatalf("read back %d links, expected %d", len(links), len(want))
+	}
+	for i := len(links) - 1; i >= 0; i-- {
+		err = storelink(links[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := exportedlinks(t)
+	if len(got) != len(want) {
+		t.Fatalf("imported %d links, expected %d", len(got), len(want))
+	}
+	for url, w := range want {
+		g := got[url]
+		if g == nil {
+			t.Errorf("lost %s", url)
+			continue
+		}
+		// scheduled links come back as drafts
+		if w.PublishAt != nil {
+			w.Draft = true
+			w.PublishAt = nil
+		}
+		if g.Title != w.Title || g.PlainSummary != w.PlainSummary || g.Source != w.Source ||
+			g.Visibility != w.Visibility || g.Draft != w.Draft || !reflect.DeepEqual(g.Tags, w.Tags) {
+			t.Errorf("%s\nresult: %+v\nexpected: %+v", url, g, w)
+		}
+		if !w.Draft && !g.Posted.Equal(w.Posted) {
+			t.Errorf("%s posted %s, expected %s", url, g.Posted, w.Posted)
+		}
+		if g.PublishAt != nil {
+			t.Errorf("%s publishes at %v", url, g.PublishAt)
+		}
+	}
+}
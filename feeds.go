@@ -0,0 +1,324 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// a feed of links for one of the views showlinks supports
+type linkfeed struct {
+	Title       string
+	Description string
+	Path        string
+	Query       string
+	Random      bool
+	Links       []*Link
+}
+
+func (feed *linkfeed) home() string {
+	if feed.Path == "" {
+		return serverURL + "/"
+	}
+	return serverURL + feed.Path + feed.Query
+}
+
+func (feed *linkfeed) self(kind string) string {
+	return serverURL + feed.Path + "/" + kind + feed.Query
+}
+
+func (feed *linkfeed) modtime() time.Time {
+	var modtime time.Time
+	for _, link := range feed.Links {
+		if link.Posted.After(modtime) {
+			modtime = link.Posted
+		}
+	}
+	return modtime
+}
+
+// getlinkfeed returns nil for a collection that doesn't exist
+func getlinkfeed(r *http.Request) *linkfeed {
+	collection := mux.Vars(r)["collection"]
+	tagname := mux.Vars(r)["tagname"]
+	sitename := mux.Vars(r)["sitename"]
+	sourcename := mux.Vars(r)["sourcename"]
+	search := r.FormValue("q")
+
+	feed := &linkfeed{Title: "inks", Description: "inks"}
+	if strings.HasPrefix(r.URL.Path, "/random/") {
+		feed.Title = "random inks"
+		feed.Description = "random inks"
+		feed.Path = "/random"
+		feed.Random = true
+		rows, err := stmtRandomLinks.Query(visPublic)
+		feed.Links, _ = readlinks(rows, err)
+		return feed
+	}
+	if strings.HasPrefix(r.URL.Path, "/search/") && search != "" {
+		feed.Title = "inks search: " + search
+		feed.Description = "inks matching " + search
+		feed.Path = "/search"
+		feed.Query = "?q=" + url.QueryEscape(search)
+	} else if collection != "" {
+		c := getcollection(collection)
+		if c == nil {
+			return nil
+		}
+		feed.Title = "inks: " + c.Title
+		feed.Description = c.Title
+		feed.Path = "/c/" + collection
+	} else if tagname != "" {
+		feed.Title = "inks tag: " + tagname
+		feed.Description = "inks tagged " + tagname
+		feed.Path = "/tag/" + tagname
+	} else if sourcename != "" {
+		feed.Title = "inks source: " + sourcename
+		feed.Description = "inks via " + sourcename
+		feed.Path = "/source/" + sourcename
+	} else if sitename != "" {
+		feed.Title = "inks site: " + sitename
+		feed.Description = "inks from " + sitename
+		feed.Path = "/site/" + sitename
+	} else {
+		search = ""
+	}
+	feed.Links, _ = querylinks(collection, tagname, sitename, sourcename, search, 123456789012, visPublic)
+	return feed
+}
+
+func linkguid(link *Link) string {
+	return fmt.Sprintf("tag:%s:inks-%d", tagName, link.ID)
+}
+
+func linkcontent(link *Link) string {
+	summary := string(link.Summary)
+	if link.Source != "" {
+		summary += "\n<p>source: " + html.EscapeString(link.Source)
+	}
+	return summary
+}
+
+// feedcache sets the caching headers for a feed, and returns true if
+// the client's copy is still good and nothing more need be sent.
+func feedcache(w http.ResponseWriter, r *http.Request, feed *linkfeed) bool {
+	if feed.Random {
+		w.Header().Set("Cache-Control", "max-age=86400")
+		return false
+	}
+	w.Header().Set("Cache-Control", "max-age=300")
+	modtime := feed.modtime()
+	if modtime.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err == nil && !modtime.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string         `xml:"title"`
+	ID        string         `xml:"id"`
+	Link      []atomLink     `xml:"link"`
+	Published string         `xml:"published"`
+	Updated   string         `xml:"updated"`
+	Category  []atomCategory `xml:"category"`
+	Content   atomText       `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Link     []atomLink  `xml:"link"`
+	Updated  string      `xml:"updated"`
+	Author   atomPerson  `xml:"author"`
+	Icon     string      `xml:"icon,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+func writeatom(w io.Writer, feed *linkfeed) error {
+	af := atomFeed{
+		Title:    feed.Title,
+		Subtitle: feed.Description,
+		ID:       feed.self("atom"),
+		Link: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feed.self("atom")},
+			{Rel: "alternate", Type: "text/html", Href: feed.home()},
+		},
+		Updated: feed.modtime().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: serverName, URI: serverURL},
+		Icon:    serverURL + "/icon.png",
+	}
+	for _, link := range feed.Links {
+		dt := link.Posted.UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			Title: link.Title,
+			ID:    linkguid(link),
+			Link: []atomLink{
+				{Rel: "alternate", Href: link.URL},
+				{Rel: "related", Type: "text/html", Href: fmt.Sprintf("%s/l/%d", serverURL, link.ID)},
+			},
+			Published: dt,
+			Updated:   dt,
+			Content:   atomText{Type: "html", Body: linkcontent(link)},
+		}
+		for _, t := range link.Tags {
+			entry.Category = append(entry.Category, atomCategory{Term: t})
+		}
+		af.Entries = append(af.Entries, entry)
+	}
+	io.WriteString(w, xml.Header)
+	e := xml.NewEncoder(w)
+	e.Indent("", " ")
+	return e.Encode(&af)
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	ExternalURL   string   `json:"external_url,omitempty"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	DatePublished string   `json:"date_published"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+func writejsonfeed(w io.Writer, feed *linkfeed) error {
+	jf := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		HomePageURL: feed.home(),
+		FeedURL:     feed.self("feed.json"),
+		Description: feed.Description,
+		Icon:        serverURL + "/icon.png",
+		Authors:     []jsonFeedAuthor{{Name: serverName, URL: serverURL}},
+		Items:       []jsonFeedItem{},
+	}
+	for _, link := range feed.Links {
+		jf.Items = append(jf.Items, jsonFeedItem{
+			ID:            linkguid(link),
+			URL:           fmt.Sprintf("%s/l/%d", serverURL, link.ID),
+			ExternalURL:   link.URL,
+			Title:         link.Title,
+			ContentHTML:   linkcontent(link),
+			DatePublished: link.Posted.UTC().Format(time.RFC3339),
+			Tags:          link.Tags,
+		})
+	}
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", " ")
+	return e.Encode(&jf)
+}
+
+func showatom(w http.ResponseWriter, r *http.Request) {
+	log.Printf("view atom")
+	feed := getlinkfeed(r)
+	if feed == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if feedcache(w, r, feed) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	err := writeatom(w, feed)
+	if err != nil {
+		log.Printf("error writing atom: %s", err)
+	}
+}
+
+func showjsonfeed(w http.ResponseWriter, r *http.Request) {
+	log.Printf("view json feed")
+	feed := getlinkfeed(r)
+	if feed == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if feedcache(w, r, feed) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	err := writejsonfeed(w, feed)
+	if err != nil {
+		log.Printf("error writing json feed: %s", err)
+	}
+}
+
+func feedroutes(getters *mux.Router) {
+	for _, prefix := range []string{"", "/random", "/search",
+		"/c/{collection:[[:alnum:]-]+}",
+		"/site/{sitename:[[:alnum:].-]+}",
+		"/source/{sourcename:[[:alnum:].-]+}",
+		"/tag/{tagname:[[:alnum:].-]+}"} {
+		getters.HandleFunc(prefix+"/rss", cachepage(showrss))
+		getters.HandleFunc(prefix+"/atom", cachepage(showatom))
+		getters.HandleFunc(prefix+"/feed.json", cachepage(showjsonfeed))
+	}
+}
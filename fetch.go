@@ -0,0 +1,328 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var fetchLimit int64 = 1024 * 1024
+var fetchAgent = "inks"
+
+// only for testing against local servers
+var fetchPrivateOK = false
+
+var errFetchTooBig = errors.New("page too large")
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, s := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		privateNets = append(privateNets, n)
+	}
+}
+
+func isprivateip(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checked after resolution, so redirects and dns tricks are covered too
+func fetchcontrol(network, address string, c syscall.RawConn) error {
+	if fetchPrivateOK {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isprivateip(ip) {
+		return fmt.Errorf("refusing to fetch from %s", host)
+	}
+	return nil
+}
+
+var fetchclient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: fetchcontrol,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("bad redirect scheme %s", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// fetchpage gets at most limit bytes of a page with one of the given content
+// types. If there's more, the truncated data is returned with errFetchTooBig.
+// The returned url is the final one after any redirects.
+func fetchpage(pageurl string, limit int64, types []string) ([]byte, string, string, error) {
+	u, err := url.Parse(pageurl)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", "", fmt.Errorf("can't fetch %s urls", u.Scheme)
+	}
+	req, err := http.NewRequest("GET", pageurl, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("User-Agent", fetchAgent)
+	req.Header.Set("Accept", strings.Join(types, ", "))
+	resp, err := fetchclient.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("http get status: %d", resp.StatusCode)
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ok := false
+	for _, t := range types {
+		if ct == t {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, "", "", fmt.Errorf("unexpected content type: %s", ct)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	final := resp.Request.URL.String()
+	if int64(len(data)) > limit {
+		return data[:limit], final, ct, errFetchTooBig
+	}
+	return data, final, ct, nil
+}
+
+var htmlTypes = []string{"text/html", "application/xhtml+xml"}
+
+type PageMeta struct {
+	URL         string
+	Title       string
+	Description string
+	Tags        []string
+}
+
+// fetchmeta pulls the interesting bits out of a page's head
+func fetchmeta(pageurl string) (*PageMeta, error) {
+	data, final, _, err := fetchpage(pageurl, fetchLimit, htmlTypes)
+	if err != nil && err != errFetchTooBig {
+		return nil, err
+	}
+	meta := parsemeta(string(data))
+	if meta.URL == "" {
+		meta.URL = final
+	} else if base, err := url.Parse(final); err == nil {
+		if u, err := base.Parse(meta.URL); err == nil {
+			meta.URL = u.String()
+		}
+	}
+	return meta, nil
+}
+
+var re_title = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var re_metatag = regexp.MustCompile(`(?is)<(meta|link)\s[^>]*>`)
+var re_attr = regexp.MustCompile(`(?s)([\w:-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+
+func tagattrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range re_attr.FindAllStringSubmatch(tag, -1) {
+		v := m[2]
+		if v[0] == '"' || v[0] == '\'' {
+			v = v[1 : len(v)-1]
+		}
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(v)
+	}
+	return attrs
+}
+
+func cleantext(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+func parsemeta(page string) *PageMeta {
+	meta := new(PageMeta)
+	props := make(map[string]string)
+	if end := strings.Index(strings.ToLower(page), "</head>"); end != -1 {
+		page = page[:end]
+	}
+	if m := re_title.FindStringSubmatch(page); m != nil {
+		meta.Title = cleantext(m[1])
+	}
+	seen := make(map[string]bool)
+	for _, m := range re_metatag.FindAllStringSubmatch(page, -1) {
+		attrs := tagattrs(m[0])
+		if strings.ToLower(m[1]) == "link" {
+			if strings.ToLower(attrs["rel"]) == "canonical" && meta.URL == "" {
+				meta.URL = attrs["href"]
+			}
+			continue
+		}
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		name = strings.ToLower(name)
+		content := strings.Join(strings.Fields(attrs["content"]), " ")
+		if name == "" || content == "" {
+			continue
+		}
+		if name == "article:tag" {
+			tag := cleantag(content)
+			if tag != "" && !seen[tag] {
+				seen[tag] = true
+				meta.Tags = append(meta.Tags, tag)
+			}
+			continue
+		}
+		if _, ok := props[name]; !ok {
+			props[name] = content
+		}
+	}
+	if meta.Title == "" {
+		meta.Title = props["og:title"]
+	}
+	if meta.Title == "" {
+		meta.Title = props["twitter:title"]
+	}
+	for _, name := range []string{"og:description", "twitter:description", "description"} {
+		if d := props[name]; d != "" {
+			meta.Description = d
+			break
+		}
+	}
+	if meta.URL == "" {
+		meta.URL = props["og:url"]
+	}
+	return meta
+}
+
+var fetchtext = false
+var textq = make(chan int64, 1000)
+var textLimit = 64 * 1024
+
+func queuetext(linkid int64) {
+	if !fetchtext {
+		return
+	}
+	select {
+	case textq <- linkid:
+	default:
+		log.Printf("text queue full, skipping %d", linkid)
+	}
+}
+
+func textfetcher() {
+	for linkid := range textq {
+		err := savetext(linkid)
+		if err != nil {
+			log.Printf("error fetching text for %d: %s", linkid, err)
+		}
+	}
+}
+
+// savetext stores the readable text of a link in remnants for searching
+func savetext(linkid int64) error {
+	var textid int64
+	var url string
+	row := stmtLinkURL.QueryRow(linkid)
+	err := row.Scan(&textid, &url)
+	if err != nil {
+		return err
+	}
+	data, _, _, err := fetchpage(url, fetchLimit, htmlTypes)
+	if err != nil && err != errFetchTooBig {
+		return err
+	}
+	text := readabletext(string(data))
+	if len(text) > textLimit {
+		text = text[:textLimit]
+		text = strings.ToValidUTF8(text, "")
+	}
+	_, err = stmtSaveRemnants.Exec(url+"\n"+text, textid)
+	return err
+}
+
+func reindex() {
+	db := opendatabase()
+	prepareStatements(db)
+	rows, err := db.Query("select linkid from links order by linkid")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var linkids []int64
+	for rows.Next() {
+		var linkid int64
+		err = rows.Scan(&linkid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		linkids = append(linkids, linkid)
+	}
+	rows.Close()
+	for _, linkid := range linkids {
+		err = savetext(linkid)
+		if err != nil {
+			log.Printf("error fetching text for %d: %s", linkid, err)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
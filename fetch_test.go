@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testpage = `<!doctype html>
+<html><head>
+<meta charset="utf-8">
+<title>
+  The  Title &amp; More
+</title>
+<link rel="canonical" href="/canon">
+<meta property="og:title" content="og title">
+<meta name="twitter:description" content="twitter words">
+<meta property="og:description" content="Some &quot;good&quot; words">
+<meta property="article:tag" content="Go">
+<meta property="article:tag" content="Open Source">
+<meta property="article:tag" content="go">
+</head>
+<body>
+<meta property="article:tag" content="ignored">
+</body></html>
+`
+
+func fetchserver() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, testpage)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "png")
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>big</title>")
+		fmt.Fprint(w, strings.Repeat("x", int(fetchLimit)))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>slow</title>")
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFetchMeta(t *testing.T) {
+	srv := fetchserver()
+	defer srv.Close()
+	fetchPrivateOK = true
+	defer func() { fetchPrivateOK = false }()
+
+	meta, err := fetchmeta(srv.URL + "/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "The Title & More" {
+		t.Errorf("title: %q", meta.Title)
+	}
+	if meta.Description != `Some "good" words` {
+		t.Errorf("description: %q", meta.Description)
+	}
+	if meta.URL != srv.URL+"/canon" {
+		t.Errorf("url: %q", meta.URL)
+	}
+	if strings.Join(meta.Tags, " ") != "go open-source" {
+		t.Errorf("tags: %q", meta.Tags)
+	}
+
+	meta, err = fetchmeta(srv.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "big" || meta.URL != srv.URL+"/big" {
+		t.Errorf("big page: %q %q", meta.Title, meta.URL)
+	}
+	_, _, _, err = fetchpage(srv.URL+"/big", fetchLimit, htmlTypes)
+	if err != errFetchTooBig {
+		t.Errorf("big page not too big: %v", err)
+	}
+}
+
+func TestFetchRefusals(t *testing.T) {
+	srv := fetchserver()
+	defer srv.Close()
+	fetchPrivateOK = true
+	defer func() { fetchPrivateOK = false }()
+
+	_, err := fetchmeta(srv.URL + "/image")
+	if err == nil {
+		t.Errorf("fetched an image")
+	}
+	_, err = fetchmeta(srv.URL + "/missing")
+	if err == nil {
+		t.Errorf("fetched a 404")
+	}
+	_, err = fetchmeta("file:///etc/passwd")
+	if err == nil {
+		t.Errorf("fetched a file")
+	}
+
+	timeout := fetchclient.Timeout
+	fetchclient.Timeout = 100 * time.Millisecond
+	_, err = fetchmeta(srv.URL + "/slow")
+	fetchclient.Timeout = timeout
+	if err == nil {
+		t.Errorf("slow page didn't time out")
+	}
+
+	fetchPrivateOK = false
+	// a kept alive connection would skip the dial check
+	fetchclient.CloseIdleConnections()
+	_, err = fetchmeta(srv.URL + "/page")
+	if err == nil {
+		t.Errorf("fetched from a private address")
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.1", true},
+		{"169.254.169.254", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"fd00::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+	}
+	for _, test := range tests {
+		if isprivateip(net.ParseIP(test.ip)) != test.private {
+			t.Errorf("%s private should be %v", test.ip, test.private)
+		}
+	}
+}
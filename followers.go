@@ -0,0 +1,470 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/junk"
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// only show how many, not who
+var hideFollowers = false
+
+type Follower struct {
+	ID        int64
+	URL       string
+	Of        string
+	Followed  string
+	Inbox     string
+	FirstFail string
+	Dead      bool
+	Pending   int64
+}
+
+func getfollowers() []*Follower {
+	rows, err := stmtFollowerHealth.Query()
+	if err != nil {
+		log.Printf("error getting followers: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var followers []*Follower
+	for rows.Next() {
+		f := new(Follower)
+		var dead int
+		err = rows.Scan(&f.ID, &f.URL, &f.Of, &f.Followed, &f.Inbox, &f.FirstFail, &dead, &f.Pending)
+		if err != nil {
+			log.Printf("error scanning follower: %s", err)
+			continue
+		}
+		f.Dead = dead != 0
+		followers = append(followers, f)
+	}
+	return followers
+}
+
+func savefollower(actor string, inbox string, collectionid int64) {
+	dt := time.Now().UTC().Format(dbtimeformat)
+	stmtDeleteFollower.Exec(actor, collectionid)
+	_, err := stmtSaveFollower.Exec(actor, dt, inbox, collectionid)
+	if err != nil {
+		log.Printf("error saving follower: %s", err)
+	}
+}
+
+// apCollection serves an OrderedCollection of actor ids, a page at a time
+func apCollection(w http.ResponseWriter, r *http.Request, id string, total int64,
+	getpage func(before int64) ([]string, int64)) {
+	j := junk.New()
+	j["@context"] = apContext
+	if r.FormValue("page") == "" {
+		j["id"] = id
+		j["type"] = "OrderedCollection"
+		j["totalItems"] = total
+		if !hideFollowers {
+			j["first"] = id + "?page=true"
+		}
+		w.Header().Set("Content-Type", apBestType)
+		j.Write(w)
+		return
+	}
+	if hideFollowers {
+		ap403(w, r)
+		return
+	}
+	before, _ := strconv.ParseInt(r.FormValue("before"), 10, 0)
+	if before > 0 {
+		j["id"] = fmt.Sprintf("%s?page=true&before=%d", id, before)
+	} else {
+		j["id"] = id + "?page=true"
+		before = 123456789012
+	}
+	items, last := getpage(before)
+	if items == nil {
+		items = []string{}
+	}
+	j["type"] = "OrderedCollectionPage"
+	j["partOf"] = id
+	j["totalItems"] = total
+	j["orderedItems"] = items
+	if len(items) == 20 {
+		j["next"] = fmt.Sprintf("%s?page=true&before=%d", id, last)
+	}
+	w.Header().Set("Content-Type", apBestType)
+	j.Write(w)
+}
+
+func apFollowers(w http.ResponseWriter, r *http.Request) {
+	if getuser(r).Is("admin") && !isActivity(r.Header.Get("Accept")) {
+		showfollowers(w, r)
+		return
+	}
+	apFollowersOf(w, r, nil)
+}
+
+func apFollowersOf(w http.ResponseWriter, r *http.Request, c *Collection) {
+	var cid int64
+	if c != nil {
+		cid = c.ID
+	}
+	var total int64
+	row := stmtCountFollowers.QueryRow(cid)
+	row.Scan(&total)
+	apCollection(w, r, c.URL()+"/followers", total, func(before int64) ([]string, int64) {
+		rows, err := stmtFollowersPage.Query(cid, before)
+		if err != nil {
+			log.Printf("error getting followers: %s", err)
+			return nil, 0
+		}
+		defer rows.Close()
+		var actors []string
+		var followerid int64
+		for rows.Next() {
+			var actor string
+			rows.Scan(&followerid, &actor)
+			actors = append(actors, actor)
+		}
+		return actors, followerid
+	})
+}
+
+// we don't follow anybody
+func apFollowing(w http.ResponseWriter, r *http.Request) {
+	apCollection(w, r, serverURL+"/following", 0, func(before int64) ([]string, int64) {
+		return nil, 0
+	})
+}
+
+func showfollowers(w http.ResponseWriter, r *http.Request) {
+	templinfo := getInfo(r)
+	templinfo["RemoveCSRF"] = login.GetCSRF("removefollower", r)
+	templinfo["ModerateCSRF"] = login.GetCSRF("moderate", r)
+	templinfo["Followers"] = getfollowers()
+	templinfo["Pending"] = getpending()
+	templinfo["Blocks"] = getblocks()
+	err := readviews.Execute(w, "followers.html", templinfo)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func removefollower(w http.ResponseWriter, r *http.Request) {
+	followerid, _ := strconv.ParseInt(r.FormValue("followerid"), 10, 0)
+	_, err := stmtRemoveFollower.Exec(followerid)
+	if err != nil {
+		log.Printf("error removing follower: %s", err)
+	}
+	http.Redirect(w, r, "/followers", http.StatusSeeOther)
+}
+
+// hold follow requests until somebody says yes
+var approveFollowers = false
+
+type Pending struct {
+	ID        int64
+	Actor     string
+	Requested string
+}
+
+type Block struct {
+	ID    int64
+	Name  string
+	Added string
+}
+
+func savepending(actor string, req junk.Junk, collectionid int64) {
+	dt := time.Now().UTC().Format(dbtimeformat)
+	stmtDeletePending.Exec(actor, collectionid)
+	_, err := stmtSavePending.Exec(actor, dt, string(req.ToBytes()), collectionid)
+	if err != nil {
+		log.Printf("error saving follow request: %s", err)
+	}
+}
+
+func getpending() []*Pending {
+	rows, err := stmtGetPending.Query()
+	if err != nil {
+		log.Printf("error getting follow requests: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var pending []*Pending
+	for rows.Next() {
+		p := new(Pending)
+		err = rows.Scan(&p.ID, &p.Actor, &p.Requested)
+		if err != nil {
+			log.Printf("error scanning follow request: %s", err)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// answerpending accepts or rejects a follow request
+func answerpending(pendingid int64, accept bool) error {
+	var req string
+	row := stmtGetOnePending.QueryRow(pendingid)
+	err := row.Scan(&req)
+	if err != nil {
+		return fmt.Errorf("no follow request %d", pendingid)
+	}
+	j, err := junk.FromBytes([]byte(req))
+	if err != nil {
+		return err
+	}
+	if accept {
+		err = apAccept(j)
+		if err != nil {
+			return err
+		}
+	} else {
+		// they're rejected even if they don't hear about it
+		apReject(j)
+	}
+	stmtDeleteOnePending.Exec(pendingid)
+	return nil
+}
+
+func getblocks() []*Block {
+	rows, err := stmtGetBlocks.Query()
+	if err != nil {
+		log.Printf("error getting blocks: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var blocks []*Block
+	for rows.Next() {
+		b := new(Block)
+		err = rows.Scan(&b.ID, &b.Name, &b.Added)
+		if err != nil {
+			log.Printf("error scanning block: %s", err)
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// a block is either an actor id or a domain, which includes subdomains
+func blockmatch(name string, u string) bool {
+	if strings.Contains(name, "://") {
+		return name == u
+	}
+	p, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(p.Hostname())
+	return host == name || strings.HasSuffix(host, "."+name)
+}
+
+// blocks are checked for every activity and delivery, so the names are
+// kept around. Changes by other processes show up after a while.
+var blocknames []string
+var blockswhen time.Time
+var blocklock sync.Mutex
+
+func forgetblocks() {
+	blocklock.Lock()
+	blocknames = nil
+	blocklock.Unlock()
+}
+
+func isblocked(u string) bool {
+	if u == "" {
+		return false
+	}
+	blocklock.Lock()
+	if blocknames == nil || time.Since(blockswhen) > pageCacheTime {
+		blocknames = []string{}
+		for _, b := range getblocks() {
+			blocknames = append(blocknames, b.Name)
+		}
+		blockswhen = time.Now()
+	}
+	names := blocknames
+	blocklock.Unlock()
+	for _, name := range names {
+		if blockmatch(name, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanblock(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, "://") {
+		return name
+	}
+	name = strings.TrimPrefix(name, "@")
+	if i := strings.LastIndexByte(name, '@'); i != -1 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// addblock also drops any followers and requests it covers
+func addblock(name string) error {
+	name = cleanblock(name)
+	if name == "" {
+		return fmt.Errorf("nothing to block")
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	stmtDeleteBlock.Exec(name)
+	_, err := stmtSaveBlock.Exec(name, dt)
+	forgetblocks()
+	if err != nil {
+		return err
+	}
+	for _, f := range getfollowers() {
+		if blockmatch(name, f.URL) {
+			stmtRemoveFollower.Exec(f.ID)
+		}
+	}
+	for _, p := range getpending() {
+		if blockmatch(name, p.Actor) {
+			stmtDeleteOnePending.Exec(p.ID)
+		}
+	}
+	rows, err := stmtReactingActors.Query()
+	if err != nil {
+		return err
+	}
+	var actors []string
+	for rows.Next() {
+		var actor string
+		rows.Scan(&actor)
+		if blockmatch(name, actor) {
+			actors = append(actors, actor)
+		}
+	}
+	rows.Close()
+	for _, actor := range actors {
+		stmtPurgeReplies.Exec(actor)
+		stmtPurgeReactions.Exec(actor)
+	}
+	if len(actors) > 0 {
+		touchcatalog()
+	}
+	return nil
+}
+
+func savemoderation(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.FormValue("action") {
+	case "accept", "reject":
+		pendingid, _ := strconv.ParseInt(r.FormValue("pendingid"), 10, 0)
+		err = answerpending(pendingid, r.FormValue("action") == "accept")
+	case "block":
+		err = addblock(r.FormValue("name"))
+	case "unblock":
+		stmtDeleteBlock.Exec(r.FormValue("name"))
+		forgetblocks()
+	default:
+		http.Error(w, "what?", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error moderating: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/followers", http.StatusSeeOther)
+}
+
+func followerscmd(args []string) {
+	db := opendatabase()
+	prepareStatements(db)
+	apLoadIdentity()
+	if len(args) < 1 {
+		log.Fatal("need an argument: followers (list|pending|accept|reject|remove|approve)")
+	}
+	switch args[0] {
+	case "list":
+		for _, f := range getfollowers() {
+			of := f.Of
+			if of == "" {
+				of = "inks"
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", f.ID, f.URL, of, f.Followed)
+		}
+	case "pending":
+		for _, p := range getpending() {
+			fmt.Printf("%d\t%s\t%s\n", p.ID, p.Actor, p.Requested)
+		}
+	case "accept", "reject":
+		if len(args) != 2 {
+			log.Fatalf("need an argument: followers %s pendingid", args[0])
+		}
+		pendingid, _ := strconv.ParseInt(args[1], 10, 0)
+		err := answerpending(pendingid, args[0] == "accept")
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "remove":
+		if len(args) != 2 {
+			log.Fatal("need an argument: followers remove actor")
+		}
+		doordie(db, "delete from followers where url = ?", args[1])
+	case "approve":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			log.Fatal("need an argument: followers approve (on|off)")
+		}
+		setconfig("approvefollowers", args[1] == "on")
+	default:
+		log.Fatal("argument must be list, pending, accept, reject, remove, or approve")
+	}
+}
+
+func blockscmd(args []string) {
+	db := opendatabase()
+	prepareStatements(db)
+	if len(args) < 1 {
+		log.Fatal("need an argument: blocks (list|add|remove)")
+	}
+	switch args[0] {
+	case "list":
+		for _, b := range getblocks() {
+			fmt.Printf("%s\t%s\n", b.Name, b.Added)
+		}
+	case "add":
+		if len(args) != 2 {
+			log.Fatal("need an argument: blocks add (actor|domain)")
+		}
+		err := addblock(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "remove":
+		if len(args) != 2 {
+			log.Fatal("need an argument: blocks remove (actor|domain)")
+		}
+		doordie(db, "delete from blocks where name = ?", cleanblock(args[1]))
+	default:
+		log.Fatal("argument must be list, add, or remove")
+	}
+}
@@ -0,0 +1,266 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func importcmd(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryrun := flags.Bool("n", false, "only report what would be imported")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("need arguments: import [-n] (json|netscape|pinboard|pocket) file")
+	}
+	format, filename := flags.Arg(0), flags.Arg(1)
+
+	fd, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var links []*Link
+	switch format {
+	case "json":
+		links, err = importJSON(fd)
+	case "netscape":
+		links, err = importNetscape(fd)
+	case "pinboard":
+		links, err = importPinboard(fd)
+	case "pocket":
+		links, err = importPocket(fd)
+	default:
+		log.Fatalf("unknown import format: %s", format)
+	}
+	fd.Close()
+	if err != nil {
+		log.Fatalf("can't read %s: %s", filename, err)
+	}
+
+	db := opendatabase()
+	prepareStatements(db)
+
+	// oldest first, so the catalog order matches the original
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Posted.Before(links[j].Posted)
+	})
+	seen := make(map[string]bool)
+	created, skipped := 0, 0
+	for _, link := range links {
+		canon := canonicalurl(link.URL)
+		if seen[canon] || findurl(link.URL) != 0 {
+			skipped++
+			continue
+		}
+		seen[canon] = true
+		if link.Title == "" {
+			link.Title = link.URL
+		}
+		if *dryrun {
+			fmt.Printf("%s %s %s\n", link.Posted.Format(dbtimeformat), link.URL, strings.Join(link.Tags, " "))
+			created++
+			continue
+		}
+		if link.Curator != "" {
+			link.UserID = finduser(link.Curator)
+		}
+		err = storelink(link)
+		if err != nil {
+			log.Printf("error importing %s: %s", link.URL, err)
+			skipped++
+			continue
+		}
+		created++
+	}
+	if *dryrun {
+		fmt.Printf("would import %d links, skipping %d\n", created, skipped)
+	} else {
+		fmt.Printf("imported %d links, skipped %d\n", created, skipped)
+	}
+}
+
+func findurl(url string) int64 {
+	var linkid int64
+	row := stmtFindURL.QueryRow(canonicalurl(url))
+	row.Scan(&linkid)
+	return linkid
+}
+
+func importtags(tags []string) []string {
+	var rv []string
+	for _, t := range tags {
+		t = cleantag(t)
+		if t != "" {
+			rv = append(rv, t)
+		}
+	}
+	return rv
+}
+
+// importJSON reads back what exportJSON writes
+func importJSON(r io.Reader) ([]*Link, error) {
+	var links []*Link
+	d := json.NewDecoder(r)
+	for {
+		link := new(Link)
+		err := d.Decode(link)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		link.ID = 0
+		link.URL = strings.TrimSpace(link.URL)
+		// better hidden than leaked
+		if !validvisibility(link.Visibility) {
+			link.Visibility = visibilities[visPrivate]
+		}
+		// imports don't go out to followers, so nothing is scheduled
+		// and collections aren't announced. Queued links stay drafts.
+		if link.PublishAt != nil {
+			link.Draft = true
+			link.PublishAt = nil
+		}
+		link.Collections = nil
+		if link.URL == "" {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+var re_netscapelink = regexp.MustCompile(`(?is)<dt>\s*<a\s([^>]*)>(.*?)</a>(?:\s*<dd>([^<]*))?`)
+
+func importNetscape(r io.Reader) ([]*Link, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var links []*Link
+	for _, m := range re_netscapelink.FindAllStringSubmatch(string(data), -1) {
+		attrs := tagattrs("<a " + m[1] + ">")
+		link := new(Link)
+		link.URL = strings.TrimSpace(attrs["href"])
+		if link.URL == "" {
+			continue
+		}
+		link.Title = cleantext(m[2])
+		link.PlainSummary = strings.TrimSpace(html.UnescapeString(m[3]))
+		if secs, err := strconv.ParseInt(attrs["add_date"], 10, 0); err == nil {
+			link.Posted = time.Unix(secs, 0).UTC()
+		}
+		link.Tags = importtags(strings.Split(attrs["tags"], ","))
+		if attrs["private"] == "1" {
+			link.Visibility = visibilities[visPrivate]
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+type pinboardPost struct {
+	Href        string `json:"href"`
+	Description string `json:"description"`
+	Extended    string `json:"extended"`
+	Time        string `json:"time"`
+	Tags        string `json:"tags"`
+	Shared      string `json:"shared"`
+}
+
+func importPinboard(r io.Reader) ([]*Link, error) {
+	var posts []pinboardPost
+	err := json.NewDecoder(r).Decode(&posts)
+	if err != nil {
+		return nil, err
+	}
+	var links []*Link
+	for _, p := range posts {
+		link := new(Link)
+		link.URL = strings.TrimSpace(p.Href)
+		if link.URL == "" {
+			continue
+		}
+		link.Title = strings.TrimSpace(p.Description)
+		link.PlainSummary = strings.TrimSpace(p.Extended)
+		link.Posted, _ = time.Parse(time.RFC3339, p.Time)
+		link.Tags = importtags(strings.Fields(p.Tags))
+		if p.Shared == "no" {
+			link.Visibility = visibilities[visPrivate]
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func importPocket(r io.Reader) ([]*Link, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.TrimSpace(strings.ToLower(h))] = i
+	}
+	field := func(rec []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+	if _, ok := cols["url"]; !ok {
+		return nil, fmt.Errorf("no url column")
+	}
+	var links []*Link
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		link := new(Link)
+		link.URL = field(rec, "url")
+		if link.URL == "" {
+			continue
+		}
+		link.Title = field(rec, "title")
+		if secs, err := strconv.ParseInt(field(rec, "time_added"), 10, 0); err == nil {
+			link.Posted = time.Unix(secs, 0).UTC()
+		}
+		link.Tags = importtags(strings.Split(field(rec, "tags"), "|"))
+		links = append(links, link)
+	}
+	return links, nil
+}
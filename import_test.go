@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func importfixture(t *testing.T, name string, fn func(io.Reader) ([]*Link, error)) []*Link {
+	fd, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	links, err := fn(fd)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return links
+}
+
+func checkimport(t *testing.T, name string, links []*Link, want []Link) {
+	if len(links) != len(want) {
+		t.Fatalf("%s: got %d links, expected %d", name, len(links), len(want))
+	}
+	for i, link := range links {
+		w := want[i]
+		if link.URL != w.URL || link.Title != w.Title || link.PlainSummary != w.PlainSummary ||
+			!link.Posted.Equal(w.Posted) || link.Visibility != w.Visibility ||
+			!reflect.DeepEqual(link.Tags, w.Tags) {
+			t.Errorf("%s link %d\nresult: %q %q %q %s %q %q\nexpected: %q %q %q %s %q %q", name, i,
+				link.URL, link.Title, link.PlainSummary, link.Posted, link.Visibility, link.Tags,
+				w.URL, w.Title, w.PlainSummary, w.Posted, w.Visibility, w.Tags)
+		}
+	}
+}
+
+func TestImportNetscape(t *testing.T) {
+	links := importfixture(t, "testdata/bookmarks.html", importNetscape)
+	checkimport(t, "netscape", links, []Link{
+		{URL: "https://lwn.net/Articles/1/", Title: "The kernel & you", PlainSummary: "A look at what's new.",
+			Posted: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Tags: []string{"kernel", "linux-news"}},
+		{URL: "https://example.com/secret", Title: "Secret page",
+			Posted: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), Visibility: "private"},
+		{URL: "https://example.org/", Title: "Lower case"},
+	})
+}
+
+func TestImportPinboard(t *testing.T) {
+	links := importfixture(t, "testdata/pinboard.json", importPinboard)
+	checkimport(t, "pinboard", links, []Link{
+		{URL: "https://lwn.net/Articles/2/", Title: "Scheduler news", PlainSummary: "More about the scheduler.",
+			Posted: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Tags: []string{"kernel", "sched"}},
+		{URL: "https://example.com/hidden", Title: "Hidden",
+			Posted: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), Visibility: "private"},
+	})
+}
+
+func TestImportPocket(t *testing.T) {
+	links := importfixture(t, "testdata/pocket.csv", importPocket)
+	checkimport(t, "pocket", links, []Link{
+		{URL: "https://go.dev/doc/go1.13", Title: "Go release notes",
+			Posted: time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC), Tags: []string{"go", "release-notes"}},
+		{URL: "https://example.com/comma", Title: "A title, with a comma",
+			Posted: time.Date(2019, 9, 2, 0, 0, 0, 0, time.UTC)},
+		{URL: "https://example.com/untitled"},
+	})
+}
+
+func TestImportJSON(t *testing.T) {
+	links := importfixture(t, "testdata/links.jsonl", importJSON)
+	if len(links) != 4 {
+		t.Fatalf("got %d links", len(links))
+	}
+	for _, link := range links {
+		if link.ID != 0 || link.PublishAt != nil || link.Collections != nil {
+			t.Errorf("%s kept id %d, publishat %v, collections %v", link.URL, link.ID, link.PublishAt, link.Collections)
+		}
+	}
+	if !links[0].Draft || !links[1].Draft || links[3].Draft {
+		t.Errorf("drafts are %v %v %v %v", links[0].Draft, links[1].Draft, links[2].Draft, links[3].Draft)
+	}
+	if links[2].Visibility != "private" || links[3].Visibility != "unlisted" {
+		t.Errorf("visibility %q %q", links[2].Visibility, links[3].Visibility)
+	}
+	if links[3].URL != "https://example.com/plain" || links[3].PlainSummary != "words" {
+		t.Errorf("plain link %q %q", links[3].URL, links[3].PlainSummary)
+	}
+}
@@ -17,11 +17,13 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
@@ -30,7 +32,6 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"humungus.tedunangst.com/r/webs/httpsig"
 	"humungus.tedunangst.com/r/webs/login"
 	"humungus.tedunangst.com/r/webs/rss"
 	"humungus.tedunangst.com/r/webs/templates"
@@ -46,27 +47,82 @@ func getInfo(r *http.Request) map[string]interface{} {
 	templinfo := make(map[string]interface{})
 	templinfo["StyleParam"] = getstyleparam("views/style.css")
 	templinfo["UserInfo"] = login.GetUserInfo(r)
+	templinfo["User"] = getuser(r)
 	templinfo["LogoutCSRF"] = login.GetCSRF("logout", r)
 	templinfo["ServerName"] = serverName
 	return templinfo
 }
 
 type Link struct {
-	ID           int64
-	URL          string
-	Posted       time.Time
-	Source       string
-	Site         string
-	Title        string
-	Tags         []string
-	PlainSummary string
-	Summary      template.HTML
-	Edit         string
+	ID           int64         `json:"id"`
+	URL          string        `json:"url"`
+	Posted       time.Time     `json:"posted"`
+	Source       string        `json:"source"`
+	Site         string        `json:"site"`
+	Title        string        `json:"title"`
+	Tags         []string      `json:"tags"`
+	PlainSummary string        `json:"summary"`
+	Summary      template.HTML `json:"html"`
+	Edit         string        `json:"-"`
+	Collections  []string      `json:"collections,omitempty"`
+	Visibility   string        `json:"visibility"`
+	Draft        bool          `json:"draft,omitempty"`
+	PublishAt    *time.Time    `json:"publishat,omitempty"`
+	Curator      string        `json:"curator,omitempty"`
+	Dead         bool          `json:"dead,omitempty"`
+	Archive      string        `json:"-"`
+	Snapshot     bool          `json:"snapshot,omitempty"`
+	Snippet      template.HTML `json:"snippet,omitempty"`
+	UserID       int64         `json:"-"`
+	Reactions    *Reactions    `json:"-"`
+}
+
+// Unlisted links are left out of lists, feeds and federation, but
+// anybody with the link can see them. Private links are only for
+// logged in users.
+const (
+	visPublic = iota
+	visUnlisted
+	visPrivate
+	visQueued
+)
+
+var visibilities = []string{"public", "unlisted", "private"}
+
+// visibility of a link by name, public if unknown
+func visibility(name string) int {
+	for i, v := range visibilities {
+		if v == name {
+			return i
+		}
+	}
+	return visPublic
+}
+
+// validvisibility checks a requested visibility, empty means the default
+func validvisibility(name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, v := range visibilities {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxvisibility is what the request may see in lists
+func maxvisibility(r *http.Request) int {
+	if getuser(r) != nil {
+		return visPrivate
+	}
+	return visPublic
 }
 
 type Tag struct {
-	Name  string
-	Count int64
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
 }
 
 func taglinks(links []*Link) {
@@ -100,22 +156,45 @@ func taglinks(links []*Link) {
 	}
 }
 
-func searchlinks(search string, lastlink int64) ([]*Link, int64) {
-	if !regexp.MustCompile(`^["[:alnum:]_ -]*$`).MatchString(search) {
-		search = ""
+// statelinks fills in who posted each link, whether it's dead and where
+// to find it instead, and whether there's a snapshot
+func statelinks(links []*Link) {
+	if len(links) == 0 {
+		return
 	}
-	quotes := 0
-	for _, c := range search {
-		if c == '"' {
-			quotes++
-		}
+	db := opendatabase()
+	var ids []string
+	lmap := make(map[int64]*Link)
+	for _, l := range links {
+		ids = append(ids, fmt.Sprintf("%d", l.ID))
+		lmap[l.ID] = l
 	}
-	if quotes%2 == 1 {
-		search = search + `"`
+	q := fmt.Sprintf("select links.linkid, links.userid, coalesce(username, ''), coalesce(brokensince, ''), exists (select 1 from snapshots where snapshots.linkid = links.linkid) from links left join users on links.userid = users.userid left join linkchecks on links.linkid = linkchecks.linkid where links.linkid in (%s)", strings.Join(ids, ","))
+	rows, err := db.Query(q)
+	if err != nil {
+		log.Printf("can't load link state: %s", err)
+		return
+	}
+	defer rows.Close()
+	archive := archiveurl()
+	for rows.Next() {
+		var lid, userid int64
+		var name, brokensince string
+		var snapshot bool
+		err = rows.Scan(&lid, &userid, &name, &brokensince, &snapshot)
+		if err != nil {
+			log.Printf("can't scan link state: %s", err)
+			continue
+		}
+		l := lmap[lid]
+		l.UserID = userid
+		l.Curator = name
+		l.Snapshot = snapshot
+		l.Dead = isdead(brokensince)
+		if l.Dead && archive != "" {
+			l.Archive = archive + l.URL
+		}
 	}
-	log.Printf("searching for '%s'", search)
-	rows, err := stmtSearchLinks.Query(search, lastlink)
-	return readlinks(rows, err)
 }
 
 func readlinks(rows *sql.Rows, err error) ([]*Link, int64) {
@@ -124,31 +203,65 @@ func readlinks(rows *sql.Rows, err error) ([]*Link, int64) {
 		return nil, 0
 	}
 	var lastlink int64
-	var links []*Link
+	var links, queued []*Link
 	for rows.Next() {
 		var link Link
 		var dt string
-		err = rows.Scan(&link.ID, &link.URL, &dt, &link.Source, &link.Site, &link.Title, &link.PlainSummary)
+		var vis int
+		err = rows.Scan(&link.ID, &link.URL, &dt, &link.Source, &link.Site, &link.Title, &link.PlainSummary, &vis)
 		if err != nil {
 			log.Printf("error scanning link: %s", err)
 			continue
 		}
+		if vis == visQueued {
+			queued = append(queued, &link)
+		} else {
+			link.Visibility = visibilities[vis]
+		}
 		link.Posted, _ = time.Parse(dbtimeformat, dt)
 		link.Summary = htmlify(link.PlainSummary)
 		links = append(links, &link)
 		lastlink = link.ID
 	}
 	rows.Close()
+	queuelinks(queued)
 	taglinks(links)
+	collectionlinks(links)
+	statelinks(links)
 	return links, lastlink
 }
 
+func querylinks(collection, tagname, sitename, sourcename, search string, lastlink int64, maxvis int) ([]*Link, int64) {
+	if search != "" {
+		return searchlinks(search, lastlink, maxvis)
+	}
+	var rows *sql.Rows
+	var err error
+	if collection != "" {
+		c := getcollection(collection)
+		if c == nil {
+			return nil, 0
+		}
+		rows, err = stmtCollectionLinks.Query(c.ID, lastlink, maxvis)
+	} else if tagname != "" {
+		rows, err = stmtTagLinks.Query(tagname, lastlink, maxvis)
+	} else if sourcename != "" {
+		rows, err = stmtSourceLinks.Query(sourcename, lastlink, maxvis)
+	} else if sitename != "" {
+		rows, err = stmtSiteLinks.Query(sitename, lastlink, maxvis)
+	} else {
+		rows, err = stmtGetLinks.Query(lastlink, maxvis)
+	}
+	return readlinks(rows, err)
+}
+
 func showlinks(w http.ResponseWriter, r *http.Request) {
 	lastlink, _ := strconv.ParseInt(mux.Vars(r)["lastlink"], 10, 0)
 	linkid, _ := strconv.ParseInt(mux.Vars(r)["linkid"], 10, 0)
 	sourcename := mux.Vars(r)["sourcename"]
 	sitename := mux.Vars(r)["sitename"]
 	tagname := mux.Vars(r)["tagname"]
+	collection := mux.Vars(r)["collection"]
 	search := r.FormValue("q")
 
 	if isActivity(r.Header.Get("Accept")) {
@@ -158,36 +271,45 @@ func showlinks(w http.ResponseWriter, r *http.Request) {
 
 	var pageinfo template.HTML
 	var links []*Link
+	maxvis := maxvisibility(r)
 	if linkid > 0 {
 		rows, err := stmtGetLink.Query(linkid)
 		links, _ = readlinks(rows, err)
+		if len(links) == 0 && gettombstone(linkid) != "" {
+			http.Error(w, "link deleted", http.StatusGone)
+			return
+		}
+		if len(links) > 0 && (links[0].Queued() || visibility(links[0].Visibility) > maxvis &&
+			visibility(links[0].Visibility) != visUnlisted) {
+			http.NotFound(w, r)
+			return
+		}
 	} else if r.URL.Path == "/random" {
-		rows, err := stmtRandomLinks.Query()
+		rows, err := stmtRandomLinks.Query(maxvis)
 		links, _ = readlinks(rows, err)
 		pageinfo = "random"
 	} else {
 		if lastlink == 0 {
 			lastlink = 123456789012
 		}
+		if collection != "" {
+			c := getcollection(collection)
+			if c == nil {
+				http.NotFound(w, r)
+				return
+			}
+			pageinfo = templates.Sprintf("collection: %s<p>follow @%s@%s", c.Title, c.Name, serverName)
+		}
+		links, lastlink = querylinks(collection, tagname, sitename, sourcename, search, lastlink, maxvis)
 		if search != "" {
-			links, lastlink = searchlinks(search, lastlink)
 			pageinfo = templates.Sprintf("search: %s", search)
 		} else if tagname != "" {
-			rows, err := stmtTagLinks.Query(tagname, lastlink)
-			links, lastlink = readlinks(rows, err)
 			pageinfo = templates.Sprintf("tag: %s", tagname)
 		} else if sourcename != "" {
-			rows, err := stmtSourceLinks.Query(sourcename, lastlink)
-			links, lastlink = readlinks(rows, err)
 			sourceinfo := htmlify(getsourceinfo(sourcename))
 			pageinfo = templates.Sprintf("source: %s<p>%s", sourcename, sourceinfo)
 		} else if sitename != "" {
-			rows, err := stmtSiteLinks.Query(sitename, lastlink)
-			links, lastlink = readlinks(rows, err)
 			pageinfo = templates.Sprintf("site: %s", sitename)
-		} else {
-			rows, err := stmtGetLinks.Query(lastlink)
-			links, lastlink = readlinks(rows, err)
 		}
 	}
 
@@ -200,9 +322,35 @@ func showlinks(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templinfo := getInfo(r)
+	if search != "" {
+		templinfo["FeedPath"] = "/search"
+		templinfo["FeedQuery"] = "?q=" + url.QueryEscape(search)
+	} else if collection != "" {
+		templinfo["FeedPath"] = "/c/" + collection
+	} else if tagname != "" {
+		templinfo["FeedPath"] = "/tag/" + tagname
+	} else if sourcename != "" {
+		templinfo["FeedPath"] = "/source/" + sourcename
+	} else if sitename != "" {
+		templinfo["FeedPath"] = "/site/" + sitename
+	} else if r.URL.Path == "/random" {
+		templinfo["FeedPath"] = "/random"
+	}
 	templinfo["Links"] = links
 	templinfo["LastLink"] = lastlink
-	templinfo["SaveCSRF"] = login.GetCSRF("savelink", r)
+	u := getuser(r)
+	if u.Is("editor") {
+		templinfo["SaveCSRF"] = login.GetCSRF("savelink", r)
+	}
+	if linkid > 0 {
+		templinfo["DeleteCSRF"] = login.GetCSRF("deletelink", r)
+		if u.Is("admin") {
+			templinfo["ReplyCSRF"] = login.GetCSRF("moderatereply", r)
+		}
+		for _, link := range links {
+			link.Reactions = getreactions(link.ID, u.Is("admin"))
+		}
+	}
 	if pageinfo != "" {
 		templinfo["PageInfo"] = pageinfo
 	}
@@ -223,66 +371,243 @@ var re_sitename = regexp.MustCompile("//([^/]+)/")
 
 var savemtx sync.Mutex
 
+var errLinkIncomplete = errors.New("need a little more info please")
+var errLinkRepeat = errors.New("check again before posting again")
+
 func savelink(w http.ResponseWriter, r *http.Request) {
-	url := strings.TrimSpace(r.FormValue("url"))
-	title := strings.TrimSpace(r.FormValue("title"))
-	summary := strings.TrimSpace(r.FormValue("summary"))
-	tags := strings.TrimSpace(r.FormValue("tags"))
-	source := strings.TrimSpace(r.FormValue("source"))
-	linkid, _ := strconv.ParseInt(r.FormValue("linkid"), 10, 0)
+	link := new(Link)
+	link.ID, _ = strconv.ParseInt(r.FormValue("linkid"), 10, 0)
+	link.URL = strings.TrimSpace(r.FormValue("url"))
+	link.Title = strings.TrimSpace(r.FormValue("title"))
+	link.PlainSummary = strings.TrimSpace(r.FormValue("summary"))
+	link.Tags = strings.Split(strings.TrimSpace(r.FormValue("tags")), " ")
+	link.Source = strings.TrimSpace(r.FormValue("source"))
+	link.Collections = strings.Fields(r.FormValue("collections"))
+	link.Visibility = r.FormValue("visibility")
+	if !validvisibility(link.Visibility) {
+		http.Error(w, "unknown visibility", http.StatusBadRequest)
+		return
+	}
+	switch r.FormValue("when") {
+	case "draft":
+		link.Draft = true
+	case "later":
+		t, err := time.Parse("2006-01-02 15:04", strings.TrimSpace(r.FormValue("publishat")))
+		if err != nil {
+			http.Error(w, "publish time should look like 2006-01-02 15:04", http.StatusBadRequest)
+			return
+		}
+		link.PublishAt = &t
+	}
+	update := link.ID > 0
+	u := getuser(r)
+	if update {
+		old := oneLink(link.ID)
+		if old == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !u.CanEdit(old) {
+			http.Error(w, "not your link", http.StatusForbidden)
+			return
+		}
+		// followers have never seen it
+		if !old.Federated() {
+			update = false
+		}
+		// there's no unpublishing
+		if !old.Queued() {
+			link.Draft = false
+			link.PublishAt = nil
+		}
+	} else {
+		link.UserID = u.ID
+		// go back to the form, unless they've seen it already
+		if r.FormValue("anyway") == "" && findduplicate(link.URL) != nil {
+			showform(w, r, link, nil)
+			return
+		}
+	}
 
+	err := storelink(link)
+	if err == errLinkIncomplete || err == errLinkRepeat {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err != nil {
+		log.Printf("error saving link: %s", err)
+		return
+	}
+	go apPublish(link.ID, update)
+	if link.Queued() {
+		http.Redirect(w, r, "/queue", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// storelink saves a new link, or replaces the existing one if ID is set.
+// New links are dated now unless Posted is set.
+// The ID and Site of the link are filled in.
+func storelink(link *Link) error {
 	savemtx.Lock()
 	defer savemtx.Unlock()
 
-	if url == "" || title == "" {
-		http.Error(w, "need a little more info please", 400)
-		return
+	if link.URL == "" || link.Title == "" {
+		return errLinkIncomplete
 	}
-
-	if linkid == 0 && url == lastlinkurl() {
-		http.Error(w, "check again before posting again", 400)
-		return
+	if link.ID == 0 && link.URL == lastlinkurl() {
+		return errLinkRepeat
 	}
 
+	title := link.Title
 	if strings.ToUpper(title) == title && strings.IndexByte(title, ' ') != -1 {
-		title = strings.Title(strings.ToLower(title))
+		link.Title = strings.Title(strings.ToLower(title))
 	}
-	site := re_sitename.FindString(url)
+	site := re_sitename.FindString(link.URL)
 	if site != "" {
 		site = site[2 : len(site)-1]
 	}
-	dt := time.Now().UTC().Format(dbtimeformat)
+	link.Site = site
+	link.Visibility = visibilities[visibility(link.Visibility)]
+	if link.Draft || (link.PublishAt != nil && !link.PublishAt.After(time.Now())) {
+		link.PublishAt = nil
+	}
+	vis := visibility(link.Visibility)
+	if link.Queued() {
+		vis = visQueued
+		if link.PublishAt != nil {
+			link.Posted = *link.PublishAt
+		}
+	}
+	if link.Posted.IsZero() {
+		link.Posted = time.Now().UTC()
+	}
+	dt := link.Posted.UTC().Format(dbtimeformat)
+	canon := canonicalurl(link.URL)
 
-	log.Printf("save link: %s", url)
+	log.Printf("save link: %s", link.URL)
 
-	res, err := stmtSaveSummary.Exec(title, summary, url)
+	res, err := stmtSaveSummary.Exec(link.Title, link.PlainSummary, link.URL)
 	if err != nil {
-		log.Printf("error saving summary: %s", err)
-		return
+		return fmt.Errorf("error saving summary: %s", err)
 	}
 	textid, _ := res.LastInsertId()
-	if linkid > 0 {
-		stmtDeleteTags.Exec(linkid)
-		_, err = stmtUpdateLink.Exec(textid, url, source, site, linkid)
-		go apPublish(linkid, true)
+	if link.ID > 0 {
+		stmtDeleteTags.Exec(link.ID)
+		stmtDeleteCheck.Exec(link.ID)
+		_, err = stmtUpdateLink.Exec(textid, link.URL, canon, link.Source, link.Site, vis, link.ID)
 	} else {
-		res, err = stmtSaveLink.Exec(textid, url, dt, source, site)
-		linkid, _ = res.LastInsertId()
-		go apPublish(linkid, false)
+		res, err = stmtSaveLink.Exec(textid, link.URL, canon, dt, link.Source, link.Site, link.UserID, vis)
+		if err == nil {
+			link.ID, _ = res.LastInsertId()
+		}
 	}
 	if err != nil {
-		log.Printf("error saving link: %s", err)
-		return
+		return err
 	}
-	for _, t := range strings.Split(tags, " ") {
+	for _, t := range link.Tags {
 		if t == "" {
 			continue
 		}
-		stmtSaveTag.Exec(linkid, t)
+		stmtSaveTag.Exec(link.ID, t)
+	}
+	savelinkcollections(link)
+	err = queuelink(link)
+	if err != nil {
+		return err
+	}
+	touchcatalog()
+	queuetext(link.ID)
+	queuesnapshot(link.ID)
+	return nil
+}
+
+func deletelink(w http.ResponseWriter, r *http.Request) {
+	linkid, _ := strconv.ParseInt(r.FormValue("linkid"), 10, 0)
+	link := oneLink(linkid)
+	if link == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !getuser(r).CanEdit(link) {
+		http.Error(w, "not your link", http.StatusForbidden)
+		return
+	}
+
+	savemtx.Lock()
+	defer savemtx.Unlock()
+
+	log.Printf("delete link: %d", linkid)
+	err := zaplink(linkid)
+	if err != nil {
+		log.Printf("error deleting link: %s", err)
+		http.Error(w, "couldn't delete that", http.StatusInternalServerError)
+		return
+	}
+	if link.Federated() {
+		go apUnpublish(linkid)
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+func zaplink(linkid int64) error {
+	db := opendatabase()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var textid int64
+	err = tx.Stmt(stmtLinkTextID).QueryRow(linkid).Scan(&textid)
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteLink).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteText).Exec(textid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteTags).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteLinkReactions).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteLinkReplies).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteLinkCollections).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteQueue).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteCheck).Exec(linkid)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteSnapshots).Exec(linkid)
+	}
+	if err == nil {
+		dt := time.Now().UTC().Format(dbtimeformat)
+		_, err = tx.Stmt(stmtSaveTombstone).Exec(linkid, dt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		touchcatalog()
+	}
+	return err
+}
+
+func gettombstone(linkid int64) string {
+	row := stmtGetTombstone.QueryRow(linkid)
+	var dt string
+	row.Scan(&dt)
+	return dt
+}
+
 func getsourceinfo(name string) string {
 	row := stmtSourceInfo.QueryRow(name)
 	var notes string
@@ -292,8 +617,8 @@ func getsourceinfo(name string) string {
 	return notes
 }
 
-func alltags() []Tag {
-	rows, err := stmtAllTags.Query()
+func alltags(maxvis int) []Tag {
+	rows, err := stmtAllTags.Query(maxvis)
 	if err != nil {
 		log.Printf("error querying tags: %s", err)
 		return nil
@@ -317,7 +642,7 @@ func alltags() []Tag {
 
 func showtags(w http.ResponseWriter, r *http.Request) {
 	templinfo := getInfo(r)
-	templinfo["Tags"] = alltags()
+	templinfo["Tags"] = alltags(maxvisibility(r))
 
 	if login.GetUserInfo(r) == nil {
 		w.Header().Set("Cache-Control", "max-age=300")
@@ -330,12 +655,12 @@ func showtags(w http.ResponseWriter, r *http.Request) {
 }
 
 type Source struct {
-	Name  string
-	Notes string
-	Info  template.HTML
+	Name  string        `json:"name"`
+	Notes string        `json:"notes"`
+	Info  template.HTML `json:"html"`
 }
 
-func getsources() []Source {
+func getsources(maxvis int) []Source {
 	m := make(map[string]*Source)
 	rows, err := stmtKnownSources.Query()
 	if err != nil {
@@ -351,7 +676,7 @@ func getsources() []Source {
 		m[s.Name] = s
 	}
 	rows.Close()
-	rows, err = stmtOtherSources.Query()
+	rows, err = stmtOtherSources.Query(maxvis)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -379,8 +704,10 @@ func getsources() []Source {
 
 func showsources(w http.ResponseWriter, r *http.Request) {
 	templinfo := getInfo(r)
-	templinfo["SaveCSRF"] = login.GetCSRF("savesource", r)
-	templinfo["Sources"] = getsources()
+	if getuser(r).Is("admin") {
+		templinfo["SaveCSRF"] = login.GetCSRF("savesource", r)
+	}
+	templinfo["Sources"] = getsources(maxvisibility(r))
 	err := readviews.Execute(w, "sources.html", templinfo)
 	if err != nil {
 		log.Print(err)
@@ -391,82 +718,50 @@ func savesource(w http.ResponseWriter, r *http.Request) {
 	notes := r.FormValue("sourcenotes")
 	stmtDeleteSource.Exec(name)
 	stmtSaveSource.Exec(name, notes)
+	touchcatalog()
 
 	http.Redirect(w, r, "/sources", http.StatusSeeOther)
 }
 
-func fillrss(links []*Link, feed *rss.Feed) time.Time {
-	var modtime time.Time
+// fillrss adds the links as items, feedcache does the dates
+func fillrss(links []*Link, feed *rss.Feed) {
 	for _, link := range links {
-		tag := fmt.Sprintf("tag:%s:inks-%d", tagName, link.ID)
-		summary := string(link.Summary)
-		if link.Source != "" {
-			summary += "\n<p>source: " + link.Source
-		}
 		feed.Items = append(feed.Items, &rss.Item{
 			Title:       link.Title,
-			Description: rss.CData{string(link.Summary)},
+			Description: rss.CData{linkcontent(link)},
 			Category:    link.Tags,
 			Link:        link.URL,
 			PubDate:     link.Posted.Format(time.RFC1123),
-			Guid:        &rss.Guid{Value: tag},
+			Guid:        &rss.Guid{Value: linkguid(link)},
 		})
-		if link.Posted.After(modtime) {
-			modtime = link.Posted
-		}
 	}
-	return modtime
-
 }
 
 func showrss(w http.ResponseWriter, r *http.Request) {
 	log.Printf("view rss")
-	home := fmt.Sprintf("https://%s/", serverName)
-	feed := rss.Feed{
-		Title:       "inks",
-		Link:        home,
-		Description: "inks rss",
-		Image: &rss.Image{
-			URL:   home + "icon.png",
-			Title: "inks rss",
-			Link:  home,
-		},
-	}
-	rows, err := stmtGetLinks.Query(123456789012)
-	links, _ := readlinks(rows, err)
-
-	modtime := fillrss(links, &feed)
-
-	w.Header().Set("Cache-Control", "max-age=300")
-	w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
-
-	err = feed.Write(w)
-	if err != nil {
-		log.Printf("error writing rss: %s", err)
+	lf := getlinkfeed(r)
+	if lf == nil {
+		http.NotFound(w, r)
+		return
 	}
-}
-
-func showrandomrss(w http.ResponseWriter, r *http.Request) {
-	log.Printf("view random rss")
-	home := fmt.Sprintf("https://%s/", serverName)
+	home := lf.home()
 	feed := rss.Feed{
-		Title:       "random inks",
+		Title:       lf.Title,
 		Link:        home,
-		Description: "random inks rss",
+		Description: lf.Description,
 		Image: &rss.Image{
-			URL:   home + "icon.png",
-			Title: "random inks rss",
+			URL:   serverURL + "/icon.png",
+			Title: lf.Title,
 			Link:  home,
 		},
 	}
-	rows, err := stmtRandomLinks.Query()
-	links, _ := readlinks(rows, err)
+	fillrss(lf.Links, &feed)
 
-	fillrss(links, &feed)
-
-	w.Header().Set("Cache-Control", "max-age=86400")
+	if feedcache(w, r, lf) {
+		return
+	}
 
-	err = feed.Write(w)
+	err := feed.Write(w)
 	if err != nil {
 		log.Printf("error writing rss: %s", err)
 	}
@@ -486,25 +781,78 @@ func servehtml(w http.ResponseWriter, r *http.Request) {
 func serveform(w http.ResponseWriter, r *http.Request) {
 	linkid, _ := strconv.ParseInt(mux.Vars(r)["linkid"], 10, 0)
 	link := new(Link)
+	var fetcherr error
 	if linkid > 0 {
-		rows, err := stmtGetLink.Query(linkid)
-		links, _ := readlinks(rows, err)
-		link = links[0]
+		link = oneLink(linkid)
+		if link == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !getuser(r).CanEdit(link) {
+			http.Error(w, "not your link", http.StatusForbidden)
+			return
+		}
+	} else if url := strings.TrimSpace(r.FormValue("url")); url != "" {
+		link.URL = url
+		meta, err := fetchmeta(url)
+		if err != nil {
+			log.Printf("error fetching %s: %s", url, err)
+			fetcherr = err
+		} else {
+			link.URL = meta.URL
+			link.Title = meta.Title
+			link.PlainSummary = meta.Description
+			link.Tags = meta.Tags
+		}
 	}
+	showform(w, r, link, fetcherr)
+}
+
+func showform(w http.ResponseWriter, r *http.Request, link *Link, fetcherr error) {
 	templinfo := getInfo(r)
+	if fetcherr != nil {
+		templinfo["FetchError"] = fetcherr.Error()
+	}
+	if link.ID == 0 && link.URL != "" {
+		if dupe := findduplicate(link.URL); dupe != nil {
+			templinfo["Duplicate"] = dupe
+		}
+	}
 	templinfo["SaveCSRF"] = login.GetCSRF("savelink", r)
+	templinfo["DeleteCSRF"] = login.GetCSRF("deletelink", r)
 	templinfo["Link"] = link
+	templinfo["Visibilities"] = visibilities
 	err := readviews.Execute(w, "addlink.html", templinfo)
 	if err != nil {
 		log.Print(err)
 	}
 }
 
-var stmtGetLink, stmtGetLinks, stmtSearchLinks, stmtSaveSummary, stmtSaveLink *sql.Stmt
+var stmtGetLink, stmtGetLinks, stmtSaveSummary, stmtSaveLink *sql.Stmt
 var stmtLastLink *sql.Stmt
+var stmtSaveDelivery, stmtDueDeliveries, stmtDeleteDelivery, stmtRetryDelivery *sql.Stmt
+var stmtGetInbox, stmtInboxFailed, stmtInboxOK, stmtInboxDead, stmtPurgeInbox *sql.Stmt
+var stmtNewestLink, stmtCountLinks, stmtLinksAfter, stmtNewerLinks, stmtOlderLinks *sql.Stmt
+var stmtLinkURL, stmtSaveRemnants, stmtFindURL *sql.Stmt
+var stmtLinkTextID, stmtDeleteLink, stmtDeleteText, stmtSaveTombstone, stmtGetTombstone *sql.Stmt
 var stmtTagLinks, stmtSiteLinks, stmtSourceLinks, stmtDeleteTags, stmtUpdateLink, stmtSaveTag *sql.Stmt
 var stmtAllTags, stmtRandomLinks *sql.Stmt
-var stmtGetFollowers, stmtSaveFollower, stmtDeleteFollower *sql.Stmt
+var stmtGetFollowers, stmtSaveFollower, stmtDeleteFollower, stmtRemoveFollower *sql.Stmt
+var stmtSavePending, stmtGetPending, stmtGetOnePending, stmtDeletePending, stmtDeleteOnePending *sql.Stmt
+var stmtGetBlocks, stmtSaveBlock, stmtDeleteBlock *sql.Stmt
+var stmtDeleteLinkReactions, stmtDeleteLinkReplies *sql.Stmt
+var stmtSaveReaction, stmtDeleteReaction, stmtCountReactions, stmtReactingActors, stmtPurgeReactions *sql.Stmt
+var stmtSaveReply, stmtDeleteReply, stmtFindReply, stmtGetReplies, stmtGetReply, stmtHideReply, stmtDeleteOneReply, stmtPurgeReplies *sql.Stmt
+var stmtGetImage, stmtImageHash, stmtImageType, stmtSaveImage, stmtDeleteImage *sql.Stmt
+var stmtGetCollections, stmtGetCollection, stmtCollectionLinks, stmtCountCollectionLinks, stmtLinkCollections *sql.Stmt
+var stmtSaveLinkCollection, stmtDeleteLinkCollection, stmtDeleteLinkCollections, stmtUnannounced, stmtSetAnnounced, stmtGetAllFollowers *sql.Stmt
+var stmtCountFollowers, stmtFollowersPage, stmtFollowerHealth, stmtSetFollowerInbox *sql.Stmt
+var stmtGetUser *sql.Stmt
+var stmtGetQueue, stmtSaveQueue, stmtDeleteQueue, stmtLastQueuePos, stmtGetQueueOrder, stmtDueQueue, stmtNextQueue, stmtSetQueueSlot *sql.Stmt
+var stmtPublishLink *sql.Stmt
+var stmtNextCheck, stmtGetCheck, stmtSaveCheck, stmtDeleteCheck, stmtBadChecks *sql.Stmt
+var stmtGetSnapshot, stmtSaveSnapshot, stmtDeleteSnapshots *sql.Stmt
+var stmtGetToken, stmtTagCount, stmtDeleteDupTags, stmtRenameTag, stmtRenameLinkSource, stmtRenameSource *sql.Stmt
 var stmtSaveSource, stmtDeleteSource, stmtSourceInfo, stmtKnownSources, stmtOtherSources *sql.Stmt
 
 func preparetodie(db *sql.DB, s string) *sql.Stmt {
@@ -516,28 +864,117 @@ func preparetodie(db *sql.DB, s string) *sql.Stmt {
 }
 
 func prepareStatements(db *sql.DB) {
-	stmtGetLink = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where linkid = ?")
+	stmtGetLink = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where linkid = ?")
 	stmtLastLink = preparetodie(db, "select url from links order by linkid desc limit 1")
-	stmtGetLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where linkid < ? order by linkid desc limit 20")
-	stmtSearchLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where linktext match ? and linkid < ? order by linkid desc limit 20")
-	stmtTagLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where linkid in (select linkid from tags where tag = ?) and linkid < ? order by linkid desc limit 20")
-	stmtSourceLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where source = ? and linkid < ? order by linkid desc limit 20")
-	stmtSiteLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid where site = ? and linkid < ? order by linkid desc limit 20")
-	stmtRandomLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary from links join linktext on links.textid = linktext.docid order by random() limit 20")
+	stmtNewestLink = preparetodie(db, "select linkid, dt from links order by linkid desc limit 1")
+	stmtGetLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ? order by dt desc, linkid desc limit 20")
+	stmtLinksAfter = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where (dt, linkid) > (select ifnull(max(dt), ''), ifnull(max(linkid), 0) from links where linkid = ?) and visibility = 0 order by dt asc, linkid asc limit 20")
+	stmtCountLinks = preparetodie(db, "select count(*) from links where visibility = 0")
+	stmtNewerLinks = preparetodie(db, "select count(*) from (select linkid from links where (dt, linkid) > (select ifnull(max(dt), ''), ifnull(max(linkid), 0) from links where linkid = ?) and visibility = 0 limit 1)")
+	stmtOlderLinks = preparetodie(db, "select count(*) from (select linkid from links where (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility = 0 limit 1)")
+	stmtSaveDelivery = preparetodie(db, "insert into deliveries (rcpt, host, msg, tries, dt, nextdt, lasterr) values (?, ?, ?, 0, ?, ?, '')")
+	stmtDueDeliveries = preparetodie(db, "select dlid, rcpt, msg, tries from (select dlid, rcpt, msg, tries, nextdt, row_number() over (partition by host order by nextdt) as n from deliveries where nextdt <= ?) where n <= ? order by nextdt limit 100")
+	stmtDeleteDelivery = preparetodie(db, "delete from deliveries where dlid = ?")
+	stmtRetryDelivery = preparetodie(db, "update deliveries set tries = ?, nextdt = ?, lasterr = ? where dlid = ?")
+	stmtGetInbox = preparetodie(db, "select firstfail, dead from inboxes where rcpt = ?")
+	stmtInboxFailed = preparetodie(db, "insert or ignore into inboxes (rcpt, firstfail, dead) values (?, ?, 0)")
+	stmtInboxOK = preparetodie(db, "delete from inboxes where rcpt = ?")
+	stmtInboxDead = preparetodie(db, "update inboxes set dead = 1 where rcpt = ?")
+	stmtPurgeInbox = preparetodie(db, "delete from deliveries where rcpt = ?")
+	stmtTagLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where linkid in (select linkid from tags where tag = ?) and (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ? order by dt desc, linkid desc limit 20")
+	stmtSourceLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where source = ? and (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ? order by dt desc, linkid desc limit 20")
+	stmtSiteLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where site = ? and (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ? order by dt desc, linkid desc limit 20")
+	stmtRandomLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where visibility <= ? order by random() limit 20")
 	stmtSaveSummary = preparetodie(db, "insert into linktext (title, summary, remnants) values (?, ?, ?)")
-	stmtSaveLink = preparetodie(db, "insert into links (textid, url, dt, source, site) values (?, ?, ?, ?, ?)")
-	stmtUpdateLink = preparetodie(db, "update links set textid = ?, url = ?, source = ?, site = ? where linkid = ?")
+	stmtSaveLink = preparetodie(db, "insert into links (linkid, textid, url, canonical, dt, source, site, userid, visibility) select max(linkid) + 1, ?, ?, ?, ?, ?, ?, ?, ? from (select linkid from links union all select linkid from tombstones union all select 0)")
+	stmtUpdateLink = preparetodie(db, "update links set textid = ?, url = ?, canonical = ?, source = ?, site = ?, visibility = ? where linkid = ?")
 	stmtDeleteTags = preparetodie(db, "delete from tags where linkid = ?")
+	stmtLinkURL = preparetodie(db, "select textid, url from links where linkid = ?")
+	stmtFindURL = preparetodie(db, "select linkid from links where canonical = ? order by linkid limit 1")
+	stmtSaveRemnants = preparetodie(db, "update linktext set remnants = ? where docid = ?")
+	stmtLinkTextID = preparetodie(db, "select textid from links where linkid = ?")
+	stmtDeleteLink = preparetodie(db, "delete from links where linkid = ?")
+	stmtDeleteText = preparetodie(db, "delete from linktext where docid = ?")
+	stmtSaveTombstone = preparetodie(db, "insert into tombstones (linkid, dt) values (?, ?)")
+	stmtGetTombstone = preparetodie(db, "select dt from tombstones where linkid = ?")
 	stmtSaveTag = preparetodie(db, "insert into tags (linkid, tag) values (?, ?)")
-	stmtAllTags = preparetodie(db, "select tag as tag, count(tag) as cnt from tags group by tag")
-	stmtGetFollowers = preparetodie(db, "select url from followers")
-	stmtSaveFollower = preparetodie(db, "insert into followers (url) values (?)")
-	stmtDeleteFollower = preparetodie(db, "delete from followers where url = ?")
+	stmtAllTags = preparetodie(db, "select tag as tag, count(tag) as cnt from tags join links on tags.linkid = links.linkid where visibility <= ? group by tag")
+	stmtGetFollowers = preparetodie(db, "select url, coalesce(inbox, '') from followers where collectionid = ?")
+	stmtGetAllFollowers = preparetodie(db, "select url, coalesce(inbox, '') from followers")
+	stmtSaveFollower = preparetodie(db, "insert into followers (url, dt, inbox, collectionid) values (?, ?, ?, ?)")
+	stmtDeleteFollower = preparetodie(db, "delete from followers where url = ? and collectionid = ?")
+	stmtRemoveFollower = preparetodie(db, "delete from followers where followerid = ?")
+	stmtSetFollowerInbox = preparetodie(db, "update followers set inbox = ? where url = ?")
+	stmtSavePending = preparetodie(db, "insert into pending (actor, dt, req, collectionid) values (?, ?, ?, ?)")
+	stmtGetPending = preparetodie(db, "select pendingid, actor, dt from pending order by pendingid")
+	stmtGetOnePending = preparetodie(db, "select req from pending where pendingid = ?")
+	stmtDeletePending = preparetodie(db, "delete from pending where actor = ? and collectionid = ?")
+	stmtDeleteOnePending = preparetodie(db, "delete from pending where pendingid = ?")
+	stmtGetBlocks = preparetodie(db, "select blockid, name, dt from blocks order by name")
+	stmtSaveBlock = preparetodie(db, "insert into blocks (name, dt) values (?, ?)")
+	stmtDeleteBlock = preparetodie(db, "delete from blocks where name = ?")
+	stmtDeleteLinkReactions = preparetodie(db, "delete from reactions where linkid = ?")
+	stmtDeleteLinkReplies = preparetodie(db, "delete from replies where linkid = ?")
+	stmtSaveReaction = preparetodie(db, "insert into reactions (linkid, kind, actor, xid, dt) values (?, ?, ?, ?, ?)")
+	stmtDeleteReaction = preparetodie(db, "delete from reactions where actor = ? and (xid = ? or (kind = ? and linkid = ?))")
+	stmtCountReactions = preparetodie(db, "select count(case when kind = 'Like' then 1 end), count(case when kind = 'Announce' then 1 end) from reactions where linkid = ?")
+	stmtReactingActors = preparetodie(db, "select actor from reactions union select actor from replies")
+	stmtPurgeReactions = preparetodie(db, "delete from reactions where actor = ?")
+	stmtSaveReply = preparetodie(db, "insert into replies (linkid, xid, actor, url, content, dt, hidden) values (?, ?, ?, ?, ?, ?, 0)")
+	stmtDeleteReply = preparetodie(db, "delete from replies where xid = ? and actor = ?")
+	stmtFindReply = preparetodie(db, "select linkid from replies where xid = ? and actor = ?")
+	stmtGetReplies = preparetodie(db, "select replyid, linkid, actor, url, content, dt, hidden from replies where linkid = ? order by dt")
+	stmtGetReply = preparetodie(db, "select linkid, actor from replies where replyid = ?")
+	stmtHideReply = preparetodie(db, "update replies set hidden = ? where replyid = ?")
+	stmtDeleteOneReply = preparetodie(db, "delete from replies where replyid = ?")
+	stmtPurgeReplies = preparetodie(db, "delete from replies where actor = ?")
+	stmtGetImage = preparetodie(db, "select mediatype, data, hash from images where name = ?")
+	stmtImageHash = preparetodie(db, "select hash from images where name = ?")
+	stmtImageType = preparetodie(db, "select mediatype from images where name = ?")
+	stmtSaveImage = preparetodie(db, "insert into images (name, mediatype, data, hash, dt) values (?, ?, ?, ?, ?)")
+	stmtDeleteImage = preparetodie(db, "delete from images where name = ?")
+	stmtGetCollections = preparetodie(db, "select collectionid, name, title from collections order by name")
+	stmtGetCollection = preparetodie(db, "select collectionid, name, title from collections where name = ?")
+	stmtCollectionLinks = preparetodie(db, "select linkid, url, dt, source, site, title, summary, visibility from links join linktext on links.textid = linktext.docid where linkid in (select linkid from linkcollections where collectionid = ?) and (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ? order by dt desc, linkid desc limit 20")
+	stmtCountCollectionLinks = preparetodie(db, "select count(*) from linkcollections join links on linkcollections.linkid = links.linkid where collectionid = ? and visibility = 0")
+	stmtLinkCollections = preparetodie(db, "select collectionid from linkcollections where linkid = ?")
+	stmtSaveLinkCollection = preparetodie(db, "insert into linkcollections (linkid, collectionid, dt, announced) values (?, ?, ?, 0)")
+	stmtDeleteLinkCollection = preparetodie(db, "delete from linkcollections where linkid = ? and collectionid = ?")
+	stmtDeleteLinkCollections = preparetodie(db, "delete from linkcollections where linkid = ?")
+	stmtUnannounced = preparetodie(db, "select collections.collectionid, name, title, linkcollections.dt from linkcollections join collections on linkcollections.collectionid = collections.collectionid where linkid = ? and announced = 0")
+	stmtSetAnnounced = preparetodie(db, "update linkcollections set announced = 1 where linkid = ? and collectionid = ?")
+	stmtCountFollowers = preparetodie(db, "select count(*) from followers where collectionid = ?")
+	stmtFollowersPage = preparetodie(db, "select followerid, url from followers where collectionid = ? and followerid < ? order by followerid desc limit 20")
+	stmtFollowerHealth = preparetodie(db, "select followerid, url, coalesce((select name from collections where collections.collectionid = followers.collectionid), ''), coalesce(dt, ''), coalesce(inbox, ''), coalesce(firstfail, ''), coalesce(dead, 0), (select count(*) from deliveries where deliveries.rcpt = followers.inbox) from followers left join inboxes on followers.inbox = inboxes.rcpt order by followerid desc")
 	stmtSourceInfo = preparetodie(db, "select notes from sources where name = ?")
 	stmtSaveSource = preparetodie(db, "insert into sources (name, notes) values (?, ?)")
 	stmtDeleteSource = preparetodie(db, "delete from sources where name = ?")
 	stmtKnownSources = preparetodie(db, "select name, notes from sources")
-	stmtOtherSources = preparetodie(db, "select distinct(source) from links")
+	stmtOtherSources = preparetodie(db, "select distinct(source) from links where visibility <= ?")
+	stmtGetQueue = preparetodie(db, "select publishdt, visibility, pos from queue where linkid = ?")
+	stmtSaveQueue = preparetodie(db, "insert into queue (linkid, publishdt, visibility, pos) values (?, ?, ?, ?)")
+	stmtDeleteQueue = preparetodie(db, "delete from queue where linkid = ?")
+	stmtLastQueuePos = preparetodie(db, "select coalesce(max(pos), 0) from queue")
+	stmtGetQueueOrder = preparetodie(db, "select linkid from queue order by publishdt = '', publishdt, pos")
+	stmtDueQueue = preparetodie(db, "select linkid from queue where publishdt != '' and publishdt <= ? order by publishdt")
+	stmtNextQueue = preparetodie(db, "select min(publishdt) from queue where publishdt != ''")
+	stmtSetQueueSlot = preparetodie(db, "update queue set publishdt = ?, pos = ? where linkid = ?")
+	stmtPublishLink = preparetodie(db, "update links set dt = ?, visibility = ? where linkid = ?")
+	stmtGetSnapshot = preparetodie(db, "select hash, mime from snapshots where linkid = ? order by snapshotid desc limit 1")
+	stmtSaveSnapshot = preparetodie(db, "insert into snapshots (linkid, hash, size, mime, url, dt) values (?, ?, ?, ?, ?, ?)")
+	stmtDeleteSnapshots = preparetodie(db, "delete from snapshots where linkid = ?")
+	stmtNextCheck = preparetodie(db, "select links.linkid, url from links left join linkchecks on links.linkid = linkchecks.linkid where checked is null or checked < ? or (brokensince != '' and checked < ?) order by checked is not null, checked limit 1")
+	stmtGetCheck = preparetodie(db, "select status, location, checked, brokensince from linkchecks where linkid = ?")
+	stmtSaveCheck = preparetodie(db, "insert or replace into linkchecks (linkid, status, location, checked, brokensince) values (?, ?, ?, ?, ?)")
+	stmtDeleteCheck = preparetodie(db, "delete from linkchecks where linkid = ?")
+	stmtBadChecks = preparetodie(db, "select linkid, status, location, checked, brokensince from linkchecks where brokensince != '' or location != '' order by brokensince = '', brokensince, linkid")
+	stmtGetUser = preparetodie(db, "select userid, username, role from users where userid = ?")
+	stmtGetToken = preparetodie(db, "select userid from apitokens where hash = ?")
+	stmtTagCount = preparetodie(db, "select count(*) from tags where tag = ?")
+	stmtDeleteDupTags = preparetodie(db, "delete from tags where tag = ? and linkid in (select linkid from tags where tag = ?)")
+	stmtRenameTag = preparetodie(db, "update tags set tag = ? where tag = ?")
+	stmtRenameLinkSource = preparetodie(db, "update links set source = ? where source = ?")
+	stmtRenameSource = preparetodie(db, "update sources set name = ? where name = ?")
 }
 
 func serve() {
@@ -549,6 +986,7 @@ func serve() {
 	}
 
 	prepareStatements(db)
+	loadcatalogstate()
 	login.Init(login.InitArgs{Db: db})
 
 	listener, err := openListener()
@@ -556,17 +994,26 @@ func serve() {
 		log.Fatal(err)
 	}
 
-	getconfig("servername", &serverName)
-	serverURL = "https://" + serverName
-	getconfig("pubkey", &serverPubKey)
-	var seckey string
-	getconfig("seckey", &seckey)
-	serverPrivateKey, _, _ = httpsig.DecodeKey(seckey)
+	apLoadIdentity()
 
 	tagName = fmt.Sprintf("%s,%d", serverName, 2019)
 
 	debug := false
 	getconfig("debug", &debug)
+	getconfig("fetchtext", &fetchtext)
+	getconfig("hidefollowers", &hideFollowers)
+	getconfig("approvefollowers", &approveFollowers)
+	getconfig("securefetch", &secureFetch)
+	if fetchtext {
+		go textfetcher()
+	}
+	snapshotconfig()
+	if snapshots {
+		go snapshotter()
+	}
+	go deliverator()
+	go scheduler()
+	go linkchecker()
 
 	readviews = templates.Load(debug,
 		"views/header.html",
@@ -574,6 +1021,10 @@ func serve() {
 		"views/tags.html",
 		"views/addlink.html",
 		"views/sources.html",
+		"views/followers.html",
+		"views/settings.html",
+		"views/queue.html",
+		"views/linkrot.html",
 		"views/login.html",
 	)
 	if !debug {
@@ -586,34 +1037,54 @@ func serve() {
 	mux.Use(login.Checker)
 
 	getters := mux.Methods("GET").Subrouter()
-	getters.HandleFunc("/", showlinks)
-	getters.HandleFunc("/search", showlinks)
-	getters.HandleFunc("/before/{lastlink:[0-9]+}", showlinks)
-	getters.HandleFunc("/l/{linkid:[0-9]+}", showlinks)
-	getters.Handle("/edit/{linkid:[0-9]+}", login.Required(http.HandlerFunc(serveform)))
-	getters.HandleFunc("/site/{sitename:[[:alnum:].-]+}", showlinks)
-	getters.HandleFunc("/source/{sourcename:[[:alnum:].-]+}", showlinks)
-	getters.HandleFunc("/tag/{tagname:[[:alnum:].-]+}", showlinks)
+	getters.HandleFunc("/", apSecure(false, cachepage(showlinks)))
+	getters.HandleFunc("/search", cachepage(showlinks))
+	getters.HandleFunc("/before/{lastlink:[0-9]+}", cachepage(showlinks))
+	getters.HandleFunc("/l/{linkid:[0-9]+}", apSecure(false, cachepage(showlinks)))
+	getters.HandleFunc("/l/{linkid:[0-9]+}/snapshot", showsnapshot)
+	getters.Handle("/edit/{linkid:[0-9]+}", roleRequired("editor", http.HandlerFunc(serveform)))
+	getters.HandleFunc("/site/{sitename:[[:alnum:].-]+}", cachepage(showlinks))
+	getters.HandleFunc("/source/{sourcename:[[:alnum:].-]+}", cachepage(showlinks))
+	getters.HandleFunc("/tag/{tagname:[[:alnum:].-]+}", cachepage(showlinks))
 	getters.HandleFunc("/random", showlinks)
-	getters.HandleFunc("/tags", showtags)
-	getters.HandleFunc("/sources", showsources)
-	getters.HandleFunc("/rss", showrss)
-	getters.HandleFunc("/random/rss", showrandomrss)
+	getters.HandleFunc("/c/{collection:[[:alnum:]-]+}", apSecure(false, cachepage(showlinks)))
+	getters.HandleFunc("/c/{collection:[[:alnum:]-]+}/{what:outbox}", apSecure(true, cachepage(apCollectionHandle)))
+	// follower changes don't touch the catalog, so no caching
+	getters.HandleFunc("/c/{collection:[[:alnum:]-]+}/{what:followers|following}", apSecure(true, apCollectionHandle))
+	getters.HandleFunc("/tags", cachepage(showtags))
+	getters.HandleFunc("/sources", cachepage(showsources))
+	feedroutes(getters)
 	getters.HandleFunc("/style.css", servecss)
 	getters.HandleFunc("/login", servehtml)
-	getters.Handle("/addlink", login.Required(http.HandlerFunc(serveform)))
+	getters.Handle("/addlink", roleRequired("editor", http.HandlerFunc(serveform)))
+	getters.Handle("/queue", roleRequired("editor", http.HandlerFunc(showqueue)))
+	getters.Handle("/linkrot", login.Required(http.HandlerFunc(showlinkrot)))
+	getters.Handle("/export", login.Required(http.HandlerFunc(serveexport)))
 	getters.HandleFunc("/logout", login.LogoutFunc)
+	getters.Handle("/settings", roleRequired("admin", http.HandlerFunc(showsettings)))
+	getters.HandleFunc("/profile/{name:avatar|header}", serveimage)
+	getters.HandleFunc("/icon.png", serveimage)
+
+	apiRoutes(mux)
 
 	posters := mux.Methods("POST").Subrouter()
-	posters.Handle("/savelink", login.CSRFWrap("savelink", http.HandlerFunc(savelink)))
-	posters.Handle("/savesource", login.CSRFWrap("savesource", http.HandlerFunc(savesource)))
+	posters.Handle("/savelink", roleRequired("editor", login.CSRFWrap("savelink", http.HandlerFunc(savelink))))
+	posters.Handle("/fixlinks", roleRequired("editor", login.CSRFWrap("fixlinks", http.HandlerFunc(fixlinks))))
+	posters.Handle("/savequeue", roleRequired("editor", login.CSRFWrap("savequeue", http.HandlerFunc(savequeue))))
+	posters.Handle("/deletelink", roleRequired("editor", login.CSRFWrap("deletelink", http.HandlerFunc(deletelink))))
+	posters.Handle("/savesource", roleRequired("admin", login.CSRFWrap("savesource", http.HandlerFunc(savesource))))
+	posters.Handle("/savesettings", roleRequired("admin", login.CSRFWrap("savesettings", http.HandlerFunc(savesettings))))
 	posters.HandleFunc("/dologin", login.LoginFunc)
 
 	getters.HandleFunc("/.well-known/webfinger", apFinger)
-	getters.HandleFunc("/outbox", apOutbox)
-	getters.HandleFunc("/followers", ap403)
-	getters.HandleFunc("/following", ap403)
+	getters.HandleFunc("/outbox", apSecure(true, cachepage(apOutbox)))
+	getters.HandleFunc("/followers", apSecure(true, apFollowers))
+	getters.HandleFunc("/following", apSecure(true, apFollowing))
+	posters.Handle("/moderate", roleRequired("admin", login.CSRFWrap("moderate", http.HandlerFunc(savemoderation))))
+	posters.Handle("/moderatereply", roleRequired("admin", login.CSRFWrap("moderatereply", http.HandlerFunc(moderatereply))))
+	posters.Handle("/removefollower", roleRequired("admin", login.CSRFWrap("removefollower", http.HandlerFunc(removefollower))))
 	posters.HandleFunc("/inbox", apInbox)
+	posters.HandleFunc("/c/{collection:[[:alnum:]-]+}/inbox", apInbox)
 
 	err = http.Serve(listener, mux)
 	if err != nil {
@@ -633,19 +1104,53 @@ func main() {
 		initdb()
 	case "run":
 		serve()
-	case "debug":
+	case "debug", "fetchtext", "hidefollowers", "securefetch", "snapshots":
 		if len(args) != 2 {
-			log.Fatal("need an argument: debug (on|off)")
+			log.Fatalf("need an argument: %s (on|off)", cmd)
 		}
 		switch args[1] {
 		case "on":
-			setconfig("debug", 1)
+			setconfig(cmd, 1)
 		case "off":
-			setconfig("debug", 0)
+			setconfig(cmd, 0)
 		default:
 			log.Fatal("argument must be on or off")
 		}
 
+	case "blocks":
+		blockscmd(args[1:])
+	case "followers":
+		followerscmd(args[1:])
+	case "adduser":
+		adduser(args[1:])
+	case "deluser":
+		deluser(args[1:])
+	case "passwd":
+		passwd(args[1:])
+	case "role":
+		rolecmd(args[1:])
+	case "users":
+		listusers()
+	case "dedupe":
+		dedupe()
+	case "linkcheck":
+		linkcheckcmd(args[1:])
+	case "snapshot":
+		snapshotcmd(args[1:])
+	case "collection":
+		collectioncmd(args[1:])
+	case "deliveries":
+		deliveriescmd(args[1:])
+	case "export":
+		exportcmd(args[1:])
+	case "import":
+		importcmd(args[1:])
+	case "reindex":
+		reindex()
+	case "rotatekey":
+		rotatekey(args[1:])
+	case "token":
+		tokencmd(args[1:])
 	case "upgrade":
 		upgradedb()
 	default:
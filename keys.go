@@ -0,0 +1,220 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/httpsig"
+	"humungus.tedunangst.com/r/webs/junk"
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+var serverKeyName = ""
+var serverPubKey = "somekey"
+var serverPrivateKey httpsig.PrivateKey
+var keylock sync.Mutex
+
+// require signatures to fetch activities
+var secureFetch = false
+
+func generatekeys() (string, string, error) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	pubkey, err := httpsig.EncodeKey(&k.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	seckey, err := httpsig.EncodeKey(k)
+	if err != nil {
+		return "", "", err
+	}
+	return pubkey, seckey, nil
+}
+
+// apLoadKeys picks up a new key after rotatekey, which runs in
+// another process.
+func apLoadKeys() {
+	keyname := serverURL + "#key"
+	getconfig("keyid", &keyname)
+	keylock.Lock()
+	defer keylock.Unlock()
+	if keyname == serverKeyName {
+		return
+	}
+	var pubkey, seckey string
+	getconfig("pubkey", &pubkey)
+	getconfig("seckey", &seckey)
+	key, _, err := httpsig.DecodeKey(seckey)
+	if err != nil {
+		log.Printf("error decoding key %s: %s", keyname, err)
+		return
+	}
+	serverKeyName = keyname
+	serverPubKey = pubkey
+	serverPrivateKey = key
+}
+
+// Every actor shares the server key, under its own key id.
+func actorkeyname(actor string, keyname string) string {
+	return actor + strings.TrimPrefix(keyname, serverURL)
+}
+
+func apSigningKey(actor string) (string, httpsig.PrivateKey) {
+	apLoadKeys()
+	keylock.Lock()
+	defer keylock.Unlock()
+	return actorkeyname(actor, serverKeyName), serverPrivateKey
+}
+
+// apPublicKeys includes the previous key until its grace period is over
+func apPublicKeys(actor string) interface{} {
+	apLoadKeys()
+	keylock.Lock()
+	k := junk.New()
+	k["id"] = actorkeyname(actor, serverKeyName)
+	k["owner"] = actor
+	k["publicKeyPem"] = serverPubKey
+	keylock.Unlock()
+
+	var oldkeyid, oldpubkey, until string
+	getconfig("oldkeyid", &oldkeyid)
+	getconfig("oldpubkey", &oldpubkey)
+	getconfig("oldkeyuntil", &until)
+	dt, _ := time.Parse(dbtimeformat, until)
+	if oldkeyid == "" || oldkeyid == serverKeyName || !time.Now().UTC().Before(dt) {
+		return k
+	}
+	old := junk.New()
+	old["id"] = actorkeyname(actor, oldkeyid)
+	old["owner"] = actor
+	old["publicKeyPem"] = oldpubkey
+	return []junk.Junk{k, old}
+}
+
+func apUpdateActor(c *Collection) junk.Junk {
+	j := junk.New()
+	j["id"] = c.URL() + "/update/" + randomxid()
+	j["type"] = "Update"
+	j["actor"] = c.URL()
+	j["to"] = apPublic
+	j["cc"] = c.URL() + "/followers"
+	j["published"] = time.Now().UTC().Format(time.RFC3339)
+	actor := apActorJunk(c)
+	delete(actor, "@context")
+	j["object"] = actor
+	return j
+}
+
+func rotatekey(args []string) {
+	days := 7
+	if len(args) > 0 {
+		var err error
+		days, err = strconv.Atoi(args[0])
+		if err != nil || days < 0 {
+			log.Fatal("need an argument: rotatekey [grace days]")
+		}
+	}
+	db := opendatabase()
+	prepareStatements(db)
+	apLoadIdentity()
+
+	pubkey, seckey, err := generatekeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now().UTC()
+	keyname := fmt.Sprintf("%s#key-%d", serverURL, now.Unix())
+	// all at once, so a running server doesn't see half a key
+	config := [][2]string{
+		{"oldkeyid", serverKeyName},
+		{"oldpubkey", serverPubKey},
+		{"oldkeyuntil", now.Add(time.Duration(days) * 24 * time.Hour).Format(dbtimeformat)},
+		{"pubkey", pubkey},
+		{"seckey", seckey},
+		{"keyid", keyname},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, kv := range config {
+		_, err = tx.Exec("delete from config where key = ?", kv[0])
+		if err == nil {
+			_, err = tx.Exec("insert into config (key, value) values (?, ?)", kv[0], kv[1])
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Fatalf("can't save %s: %s", kv[0], err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	apLoadKeys()
+	touchcatalog()
+
+	apBroadcast(apUpdateActor(nil), 0)
+	for _, c := range getcollections() {
+		apBroadcast(apUpdateActor(c), c.ID)
+	}
+	fmt.Printf("new key %s\n", keyname)
+}
+
+// keyowner guesses the actor from a key id, which is usually the actor
+// with a fragment, like https://example.com/u/a#main-key
+func keyowner(keyname string) string {
+	if i := strings.IndexByte(keyname, '#'); i != -1 {
+		return keyname[:i]
+	}
+	return keyname
+}
+
+// apSecure checks signatures in secure mode. Pages that are also html
+// are only checked when asked for as activities.
+func apSecure(always bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !secureFetch || login.GetUserInfo(r) != nil ||
+			(!always && !isActivity(r.Header.Get("Accept"))) {
+			handler(w, r)
+			return
+		}
+		keyname, err := httpsig.VerifyRequest(r, nil, httpsig.ActivityPubKeyGetter)
+		if err != nil {
+			log.Printf("unsigned fetch of %s: %s", r.URL.Path, err)
+			w.Header().Set("Vary", "Accept, Signature")
+			http.Error(w, "signature required", http.StatusUnauthorized)
+			return
+		}
+		if isblocked(keyowner(keyname)) {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Vary", "Accept, Signature")
+		handler(w, r)
+	}
+}
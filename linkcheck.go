@@ -0,0 +1,273 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// Links are checked every so often to notice when they go away.
+// Good links get checked weekly, broken ones daily, and a link that
+// stays broken for two weeks is called dead.
+var checkGoodEvery = 7 * 24 * time.Hour
+var checkBrokenEvery = 24 * time.Hour
+var deadAfter = 14 * 24 * time.Hour
+
+var defaultArchive = "https://web.archive.org/web/"
+
+type LinkCheck struct {
+	Link        *Link
+	Status      int
+	Location    string
+	Checked     string
+	BrokenSince string
+	Dead        bool
+}
+
+func isdead(brokensince string) bool {
+	if brokensince == "" {
+		return false
+	}
+	dt, _ := time.Parse(dbtimeformat, brokensince)
+	return time.Since(dt) > deadAfter
+}
+
+func archiveurl() string {
+	archive := defaultArchive
+	getconfig("archiveurl", &archive)
+	return archive
+}
+
+func checkrequest(method, pageurl string) (*http.Response, error) {
+	req, err := http.NewRequest(method, pageurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchAgent)
+	resp, err := fetchclient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// checkurl returns the status of a url and where it redirects to,
+// if somewhere other than itself
+func checkurl(pageurl string) (int, string, error) {
+	if !strings.HasPrefix(pageurl, "http://") && !strings.HasPrefix(pageurl, "https://") {
+		return 0, "", fmt.Errorf("can't check %s", pageurl)
+	}
+	resp, err := checkrequest("HEAD", pageurl)
+	// plenty of servers don't know HEAD
+	if err != nil || resp.StatusCode >= 400 {
+		resp, err = checkrequest("GET", pageurl)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	location := ""
+	final := resp.Request.URL.String()
+	if canonicalurl(final) != canonicalurl(pageurl) {
+		location = final
+	}
+	return resp.StatusCode, location, nil
+}
+
+func checklink(linkid int64, pageurl string) {
+	status, location, err := checkurl(pageurl)
+	now := time.Now().UTC().Format(dbtimeformat)
+	var oldstatus int
+	var oldlocation, checked, brokensince string
+	stmtGetCheck.QueryRow(linkid).Scan(&oldstatus, &oldlocation, &checked, &brokensince)
+	// dead as of the last check, to notice going dead since
+	wasdead := false
+	if brokensince != "" {
+		b, _ := time.Parse(dbtimeformat, brokensince)
+		c, _ := time.Parse(dbtimeformat, checked)
+		wasdead = c.Sub(b) > deadAfter
+	}
+	if status == http.StatusTooManyRequests {
+		// no verdict, keep the old one and come back in turn
+		status, location = oldstatus, oldlocation
+	} else if err != nil || status >= 400 {
+		if brokensince == "" {
+			brokensince = now
+		}
+		if err != nil {
+			log.Printf("link %d check failed: %s", linkid, err)
+		}
+	} else {
+		brokensince = ""
+	}
+	_, err = stmtSaveCheck.Exec(linkid, status, location, now, brokensince)
+	if err != nil {
+		log.Printf("error saving link check: %s", err)
+	}
+	if isdead(brokensince) != wasdead {
+		touchcatalog()
+	}
+}
+
+// linkchecker checks links at the configured rate per hour
+func linkchecker() {
+	for {
+		rate := 0
+		getconfig("linkcheckrate", &rate)
+		if rate < 1 {
+			time.Sleep(1 * time.Hour)
+			continue
+		}
+		now := time.Now().UTC()
+		var linkid int64
+		var pageurl string
+		row := stmtNextCheck.QueryRow(now.Add(-checkGoodEvery).Format(dbtimeformat),
+			now.Add(-checkBrokenEvery).Format(dbtimeformat))
+		if row.Scan(&linkid, &pageurl) == nil {
+			checklink(linkid, pageurl)
+		}
+		time.Sleep(time.Hour / time.Duration(rate))
+	}
+}
+
+func getlinkchecks() []*LinkCheck {
+	rows, err := stmtBadChecks.Query()
+	if err != nil {
+		log.Printf("error getting link checks: %s", err)
+		return nil
+	}
+	var checks []*LinkCheck
+	for rows.Next() {
+		var linkid int64
+		c := new(LinkCheck)
+		err = rows.Scan(&linkid, &c.Status, &c.Location, &c.Checked, &c.BrokenSince)
+		if err != nil {
+			log.Printf("error scanning link check: %s", err)
+			continue
+		}
+		c.Dead = isdead(c.BrokenSince)
+		c.Link = &Link{ID: linkid}
+		checks = append(checks, c)
+	}
+	rows.Close()
+	var rv []*LinkCheck
+	for _, c := range checks {
+		if link := oneLink(c.Link.ID); link != nil {
+			c.Link = link
+			rv = append(rv, c)
+		}
+	}
+	return rv
+}
+
+func showlinkrot(w http.ResponseWriter, r *http.Request) {
+	templinfo := getInfo(r)
+	templinfo["FixCSRF"] = login.GetCSRF("fixlinks", r)
+	var broken, moved []*LinkCheck
+	for _, c := range getlinkchecks() {
+		if c.BrokenSince != "" {
+			broken = append(broken, c)
+		} else {
+			moved = append(moved, c)
+		}
+	}
+	templinfo["Broken"] = broken
+	templinfo["Moved"] = moved
+	templinfo["Archive"] = archiveurl()
+	err := readviews.Execute(w, "linkrot.html", templinfo)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// fixlinks follows redirects for the chosen links, or checks them again soon
+func fixlinks(w http.ResponseWriter, r *http.Request) {
+	u := getuser(r)
+	action := r.FormValue("action")
+	for _, s := range r.Form["linkid"] {
+		linkid, _ := strconv.ParseInt(s, 10, 0)
+		link := oneLink(linkid)
+		if link == nil || !u.CanEdit(link) {
+			continue
+		}
+		switch action {
+		case "follow":
+			var status int
+			var location, checked, brokensince string
+			err := stmtGetCheck.QueryRow(linkid).Scan(&status, &location, &checked, &brokensince)
+			if err != nil || location == "" || brokensince != "" {
+				continue
+			}
+			link.URL = location
+			err = storelink(link)
+			if err != nil {
+				log.Printf("error updating link %d: %s", linkid, err)
+				continue
+			}
+			go apPublish(link.ID, link.Federated())
+		case "recheck":
+			stmtDeleteCheck.Exec(linkid)
+		}
+	}
+	http.Redirect(w, r, "/linkrot", http.StatusSeeOther)
+}
+
+func linkcheckcmd(args []string) {
+	if len(args) < 1 {
+		log.Fatal("need an argument: linkcheck (rate|archive|list)")
+	}
+	switch args[0] {
+	case "rate":
+		if len(args) != 2 {
+			log.Fatal("need an argument: linkcheck rate perhour")
+		}
+		rate, err := strconv.Atoi(args[1])
+		if err != nil || rate < 0 {
+			log.Fatal("rate must be a number of links per hour")
+		}
+		setconfig("linkcheckrate", rate)
+	case "archive":
+		if len(args) != 2 {
+			log.Fatal("need an argument: linkcheck archive (url|off)")
+		}
+		archive := args[1]
+		if archive == "off" {
+			archive = ""
+		}
+		setconfig("archiveurl", archive)
+	case "list":
+		db := opendatabase()
+		prepareStatements(db)
+		for _, c := range getlinkchecks() {
+			state := "moved"
+			if c.Dead {
+				state = "dead"
+			} else if c.BrokenSince != "" {
+				state = "broken"
+			}
+			fmt.Printf("%d\t%s\t%d\t%s\t%s\n", c.Link.ID, state, c.Status, c.Link.URL, c.Location)
+		}
+	default:
+		log.Fatal("argument must be rate, archive, or list")
+	}
+}
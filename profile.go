@@ -0,0 +1,235 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/junk"
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+var imageTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+var imageLimit int64 = 2 * 1024 * 1024
+
+type Profile struct {
+	Name   string
+	Bio    string
+	Fields string
+	Avatar string
+	Header string
+}
+
+type ProfileField struct {
+	Name  string
+	Value template.HTML
+}
+
+func getprofile() *Profile {
+	p := new(Profile)
+	getconfig("displayname", &p.Name)
+	getconfig("bio", &p.Bio)
+	getconfig("profilefields", &p.Fields)
+	p.Avatar = imageurl("avatar")
+	p.Header = imageurl("header")
+	return p
+}
+
+func (p *Profile) DisplayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return serverName
+}
+
+func (p *Profile) Summary() template.HTML {
+	if p.Bio != "" {
+		return htmlify(p.Bio)
+	}
+	return template.HTML(template.HTMLEscapeString(serverName))
+}
+
+// fields are saved one per line, name: value
+func (p *Profile) PropertyValues() []ProfileField {
+	var fields []ProfileField
+	for _, line := range strings.Split(p.Fields, "\n") {
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 {
+			continue
+		}
+		name := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if name == "" || value == "" {
+			continue
+		}
+		fields = append(fields, ProfileField{Name: name, Value: htmlify(value)})
+	}
+	return fields
+}
+
+// imageurl changes with the image so remote caches notice
+func imageurl(name string) string {
+	var hash string
+	row := stmtImageHash.QueryRow(name)
+	err := row.Scan(&hash)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/profile/%s?v=%s", serverURL, name, hash[:8])
+}
+
+func apImage(u string, mediatype string) junk.Junk {
+	a := junk.New()
+	a["type"] = "Image"
+	if mediatype != "" {
+		a["mediaType"] = mediatype
+	}
+	a["url"] = u
+	return a
+}
+
+func apProfile(j junk.Junk) {
+	p := getprofile()
+	j["name"] = p.DisplayName()
+	j["summary"] = string(p.Summary())
+	if p.Avatar != "" {
+		j["icon"] = apImage(p.Avatar, imagetype("avatar"))
+	}
+	if p.Header != "" {
+		j["image"] = apImage(p.Header, imagetype("header"))
+	}
+	var attachments []junk.Junk
+	for _, f := range p.PropertyValues() {
+		a := junk.New()
+		a["type"] = "PropertyValue"
+		a["name"] = f.Name
+		a["value"] = string(f.Value)
+		attachments = append(attachments, a)
+	}
+	if len(attachments) > 0 {
+		j["attachment"] = attachments
+	}
+}
+
+func imagetype(name string) string {
+	var mediatype string
+	row := stmtImageType.QueryRow(name)
+	row.Scan(&mediatype)
+	return mediatype
+}
+
+func saveimage(name string, r *http.Request) error {
+	file, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, imageLimit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > imageLimit {
+		return fmt.Errorf("%s is too big", name)
+	}
+	mediatype := http.DetectContentType(data)
+	if imageTypes[mediatype] == "" {
+		return fmt.Errorf("%s is not an image: %s", name, mediatype)
+	}
+	hash := fmt.Sprintf("%x", sha512.Sum512_256(data))
+	dt := time.Now().UTC().Format(dbtimeformat)
+	stmtDeleteImage.Exec(name)
+	_, err = stmtSaveImage.Exec(name, mediatype, data, hash, dt)
+	return err
+}
+
+func serveimage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/profile/")
+	if r.URL.Path == "/icon.png" {
+		name = "avatar"
+	}
+	var mediatype, hash string
+	var data []byte
+	row := stmtGetImage.QueryRow(name)
+	err := row.Scan(&mediatype, &data, &hash)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + hash[:16] + `"`
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", mediatype)
+	w.Write(data)
+}
+
+func showsettings(w http.ResponseWriter, r *http.Request) {
+	templinfo := getInfo(r)
+	templinfo["SettingsCSRF"] = login.GetCSRF("savesettings", r)
+	templinfo["Profile"] = getprofile()
+	err := readviews.Execute(w, "settings.html", templinfo)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func savesettings(w http.ResponseWriter, r *http.Request) {
+	setconfig("displayname", strings.TrimSpace(r.FormValue("displayname")))
+	setconfig("bio", strings.TrimSpace(strings.Replace(r.FormValue("bio"), "\r", "", -1)))
+	setconfig("profilefields", strings.TrimSpace(strings.Replace(r.FormValue("fields"), "\r", "", -1)))
+	for _, name := range []string{"avatar", "header"} {
+		if r.FormValue("remove"+name) != "" {
+			stmtDeleteImage.Exec(name)
+			continue
+		}
+		err := saveimage(name, r)
+		if err != nil {
+			log.Printf("error saving %s: %s", name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	touchcatalog()
+	go func() {
+		apBroadcast(apUpdateActor(nil), 0)
+		// collections show the same icon and image
+		for _, c := range getcollections() {
+			apBroadcast(apUpdateActor(c), c.ID)
+		}
+	}()
+
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
@@ -0,0 +1,299 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// Drafts and scheduled links wait in the queue table, hidden from
+// everything as visQueued. The queue keeps the visibility they will
+// have once published.
+
+var schedulenudge = make(chan bool, 1)
+
+func nudgescheduler() {
+	select {
+	case schedulenudge <- true:
+	default:
+	}
+}
+
+func (link *Link) Queued() bool {
+	return link.Draft || link.PublishAt != nil
+}
+
+// Federated links are the ones followers know about
+func (link *Link) Federated() bool {
+	return link.Visibility == "public" && !link.Queued()
+}
+
+// queuelinks fills in the queue state of queued links
+func queuelinks(links []*Link) {
+	for _, link := range links {
+		var publishdt string
+		var vis int
+		var pos int64
+		row := stmtGetQueue.QueryRow(link.ID)
+		err := row.Scan(&publishdt, &vis, &pos)
+		if err != nil {
+			log.Printf("queued link %d not in queue: %s", link.ID, err)
+			link.Visibility = visibilities[visPrivate]
+			link.Draft = true
+			continue
+		}
+		link.Visibility = visibilities[vis]
+		if publishdt == "" {
+			link.Draft = true
+		} else {
+			t, _ := time.Parse(dbtimeformat, publishdt)
+			link.PublishAt = &t
+		}
+	}
+}
+
+// queuelink keeps the queue in step with a saved link. A link that was
+// queued and no longer is gets published now.
+func queuelink(link *Link) error {
+	var publishdt string
+	var vis int
+	var pos int64
+	row := stmtGetQueue.QueryRow(link.ID)
+	wasqueued := row.Scan(&publishdt, &vis, &pos) == nil
+	if !link.Queued() {
+		if wasqueued {
+			return publishlink(link, time.Now().UTC())
+		}
+		return nil
+	}
+	publishdt = ""
+	if link.PublishAt != nil {
+		publishdt = link.PublishAt.UTC().Format(dbtimeformat)
+	}
+	if !wasqueued {
+		row = stmtLastQueuePos.QueryRow()
+		row.Scan(&pos)
+		pos++
+	}
+	stmtDeleteQueue.Exec(link.ID)
+	_, err := stmtSaveQueue.Exec(link.ID, publishdt, visibility(link.Visibility), pos)
+	nudgescheduler()
+	return err
+}
+
+// publishlink takes a link out of the queue. The linkid stays, the new
+// date puts it at the top of lists, which go by date.
+func publishlink(link *Link, when time.Time) error {
+	db := opendatabase()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	dt := when.UTC().Format(dbtimeformat)
+	_, err = tx.Stmt(stmtPublishLink).Exec(dt, visibility(link.Visibility), link.ID)
+	if err == nil {
+		_, err = tx.Stmt(stmtDeleteQueue).Exec(link.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	log.Printf("published link %d", link.ID)
+	link.Posted = when.UTC()
+	link.Draft = false
+	link.PublishAt = nil
+	return nil
+}
+
+func getqueue() []*Link {
+	rows, err := stmtGetQueueOrder.Query()
+	if err != nil {
+		log.Printf("error getting queue: %s", err)
+		return nil
+	}
+	var ids []int64
+	for rows.Next() {
+		var linkid int64
+		rows.Scan(&linkid)
+		ids = append(ids, linkid)
+	}
+	rows.Close()
+	var links []*Link
+	for _, linkid := range ids {
+		link := oneLink(linkid)
+		if link != nil {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// scheduler publishes links when their time comes. The schedule is in
+// the database, so nothing is missed across restarts.
+func scheduler() {
+	for {
+		now := time.Now().UTC()
+		rows, err := stmtDueQueue.Query(now.Format(dbtimeformat))
+		var due []int64
+		if err != nil {
+			log.Printf("error getting scheduled links: %s", err)
+		} else {
+			for rows.Next() {
+				var linkid int64
+				rows.Scan(&linkid)
+				due = append(due, linkid)
+			}
+			rows.Close()
+		}
+		for _, linkid := range due {
+			link := oneLink(linkid)
+			if link == nil || link.PublishAt == nil {
+				continue
+			}
+			savemtx.Lock()
+			err := publishlink(link, *link.PublishAt)
+			savemtx.Unlock()
+			if err != nil {
+				log.Printf("error publishing link %d: %s", linkid, err)
+				continue
+			}
+			touchcatalog()
+			go apFederate(link.ID, false)
+		}
+
+		wait := time.Hour
+		var next string
+		row := stmtNextQueue.QueryRow()
+		if row.Scan(&next) == nil {
+			t, _ := time.Parse(dbtimeformat, next)
+			if d := time.Until(t); d < wait {
+				wait = d
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-schedulenudge:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func showqueue(w http.ResponseWriter, r *http.Request) {
+	templinfo := getInfo(r)
+	templinfo["QueueCSRF"] = login.GetCSRF("savequeue", r)
+	templinfo["Queue"] = getqueue()
+	err := readviews.Execute(w, "queue.html", templinfo)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// savequeue moves a link up or down among its kind, or publishes it
+func savequeue(w http.ResponseWriter, r *http.Request) {
+	linkid, _ := strconv.ParseInt(r.FormValue("linkid"), 10, 0)
+	u := getuser(r)
+
+	savemtx.Lock()
+	defer savemtx.Unlock()
+
+	queue := getqueue()
+	idx := -1
+	for i, link := range queue {
+		if link.ID == linkid {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	link := queue[idx]
+	if !u.CanEdit(link) {
+		http.Error(w, "not your link", http.StatusForbidden)
+		return
+	}
+	var other *Link
+	switch r.FormValue("action") {
+	case "up":
+		if idx > 0 {
+			other = queue[idx-1]
+		}
+	case "down":
+		if idx < len(queue)-1 {
+			other = queue[idx+1]
+		}
+	case "publish":
+		err := publishlink(link, time.Now().UTC())
+		if err != nil {
+			log.Printf("error publishing link: %s", err)
+			http.Error(w, "couldn't publish that", http.StatusInternalServerError)
+			return
+		}
+		touchcatalog()
+		go apPublish(link.ID, false)
+		http.Redirect(w, r, "/queue", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "what?", http.StatusBadRequest)
+		return
+	}
+	// drafts and scheduled links trade places, not kinds
+	if other != nil && other.Draft == link.Draft && u.CanEdit(other) {
+		err := swapqueue(link.ID, other.ID)
+		if err != nil {
+			log.Printf("error reordering queue: %s", err)
+		}
+		nudgescheduler()
+	}
+	http.Redirect(w, r, "/queue", http.StatusSeeOther)
+}
+
+func swapqueue(a, b int64) error {
+	db := opendatabase()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var adt, bdt string
+	var avis, bvis int
+	var apos, bpos int64
+	err = tx.Stmt(stmtGetQueue).QueryRow(a).Scan(&adt, &avis, &apos)
+	if err == nil {
+		err = tx.Stmt(stmtGetQueue).QueryRow(b).Scan(&bdt, &bvis, &bpos)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtSetQueueSlot).Exec(bdt, bpos, a)
+	}
+	if err == nil {
+		_, err = tx.Stmt(stmtSetQueueSlot).Exec(adt, apos, b)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
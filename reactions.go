@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/junk"
+)
+
+type Reply struct {
+	ID      int64
+	LinkID  int64
+	Actor   string
+	URL     string
+	Content template.HTML
+	Posted  string
+	Hidden  bool
+}
+
+type Reactions struct {
+	Likes     int64
+	Announces int64
+	Replies   []*Reply
+}
+
+// apLinkID returns the link an object id points at, or 0 if it isn't ours
+func apLinkID(xid string) int64 {
+	prefix := serverURL + "/l/"
+	if !strings.HasPrefix(xid, prefix) {
+		return 0
+	}
+	linkid, _ := strconv.ParseInt(xid[len(prefix):], 10, 0)
+	if linkid == 0 {
+		return 0
+	}
+	link := oneLink(linkid)
+	if link == nil || link.Visibility == "private" || link.Queued() {
+		return 0
+	}
+	return linkid
+}
+
+// objectid handles objects sent as either a plain id or the whole thing
+func objectid(j junk.Junk) string {
+	if xid, ok := j.GetString("object"); ok {
+		return xid
+	}
+	xid, _ := j.GetString("object", "id")
+	return xid
+}
+
+func savereaction(who string, j junk.Junk) {
+	what, _ := j.GetString("type")
+	xid, _ := j.GetString("id")
+	linkid := apLinkID(objectid(j))
+	if linkid == 0 {
+		return
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	stmtDeleteReaction.Exec(who, xid, what, linkid)
+	_, err := stmtSaveReaction.Exec(linkid, what, who, xid, dt)
+	if err != nil {
+		log.Printf("error saving %s: %s", what, err)
+		return
+	}
+	forgetlink(linkid)
+}
+
+func undoreaction(who string, obj junk.Junk) {
+	what, _ := obj.GetString("type")
+	xid, _ := obj.GetString("id")
+	linkid := apLinkID(objectid(obj))
+	res, err := stmtDeleteReaction.Exec(who, xid, what, linkid)
+	if err != nil {
+		log.Printf("error undoing %s: %s", what, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		forgetlink(linkid)
+	}
+}
+
+// savereply keeps notes that reply to one of our links
+func savereply(who string, obj junk.Junk) {
+	what, _ := obj.GetString("type")
+	if what != "Note" {
+		return
+	}
+	author, _ := obj.GetString("attributedTo")
+	if author != who {
+		log.Printf("reply from %s attributed to %s", who, author)
+		return
+	}
+	rid, _ := obj.GetString("inReplyTo")
+	linkid := apLinkID(rid)
+	if linkid == 0 {
+		return
+	}
+	xid, _ := obj.GetString("id")
+	if xid == "" {
+		return
+	}
+	u, ok := obj.GetString("url")
+	if !ok {
+		u = xid
+	}
+	content, _ := obj.GetString("content")
+	dt := time.Now().UTC()
+	if p, ok := obj.GetString("published"); ok {
+		if t, err := time.Parse(time.RFC3339, p); err == nil {
+			dt = t.UTC()
+		}
+	}
+	stmtDeleteReply.Exec(xid, who)
+	_, err := stmtSaveReply.Exec(linkid, xid, who, u, plaintext(content), dt.Format(dbtimeformat))
+	if err != nil {
+		log.Printf("error saving reply: %s", err)
+		return
+	}
+	forgetlink(linkid)
+}
+
+func deletereply(who string, xid string) {
+	var linkid int64
+	row := stmtFindReply.QueryRow(xid, who)
+	if row.Scan(&linkid) != nil {
+		return
+	}
+	_, err := stmtDeleteReply.Exec(xid, who)
+	if err != nil {
+		log.Printf("error deleting reply: %s", err)
+		return
+	}
+	forgetlink(linkid)
+}
+
+func getreactions(linkid int64, hidden bool) *Reactions {
+	re := new(Reactions)
+	row := stmtCountReactions.QueryRow(linkid)
+	row.Scan(&re.Likes, &re.Announces)
+	rows, err := stmtGetReplies.Query(linkid)
+	if err != nil {
+		log.Printf("error getting replies: %s", err)
+		return re
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := new(Reply)
+		var content string
+		var h int
+		err = rows.Scan(&r.ID, &r.LinkID, &r.Actor, &r.URL, &content, &r.Posted, &h)
+		if err != nil {
+			log.Printf("error scanning reply: %s", err)
+			continue
+		}
+		r.Hidden = h != 0
+		if r.Hidden && !hidden {
+			continue
+		}
+		r.Content = htmlify(content)
+		re.Replies = append(re.Replies, r)
+	}
+	return re
+}
+
+func moderatereply(w http.ResponseWriter, r *http.Request) {
+	replyid, _ := strconv.ParseInt(r.FormValue("replyid"), 10, 0)
+	var linkid int64
+	var actor string
+	row := stmtGetReply.QueryRow(replyid)
+	err := row.Scan(&linkid, &actor)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.FormValue("action") {
+	case "hide":
+		_, err = stmtHideReply.Exec(1, replyid)
+	case "show":
+		_, err = stmtHideReply.Exec(0, replyid)
+	case "delete":
+		_, err = stmtDeleteOneReply.Exec(replyid)
+	case "block":
+		err = addblock(actor)
+	default:
+		http.Error(w, "what?", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error moderating reply: %s", err)
+	}
+	if r.FormValue("action") == "block" {
+		touchcatalog()
+	} else {
+		forgetlink(linkid)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/l/%d", linkid), http.StatusSeeOther)
+}
@@ -1,22 +1,51 @@
 
-create table links(linkid integer primary key, textid integer, url text, dt text, source text, site text);
-create virtual table linktext using fts4 (title, summary, remnants);
+create table links(linkid integer primary key, textid integer, url text, canonical text, dt text, source text, site text, userid integer, visibility integer default 0);
+create table linktext (docid integer primary key, title text, summary text, remnants text);
+create virtual table linksearch using fts5 (title, summary, remnants, content='linktext', content_rowid='docid', tokenize='porter unicode61', prefix='2 3');
 create table tags (tagid integer primary key, linkid integer, tag text);
 create table sources (sourceid integer primary key, name text, notes text);
+create table tombstones (linkid integer primary key, dt text);
 
-create table followers(followerid integer primary key, url text);
+create table followers(followerid integer primary key, url text, dt text, inbox text, collectionid integer default 0);
+create table deliveries (dlid integer primary key, rcpt text, host text, msg blob, tries integer, dt text, nextdt text, lasterr text);
+create table pending (pendingid integer primary key, actor text, dt text, req text, collectionid integer default 0);
+create table collections (collectionid integer primary key, name text, title text, dt text);
+create table linkcollections (linkid integer, collectionid integer, dt text, announced integer);
+create table queue (linkid integer primary key, publishdt text, visibility integer, pos integer);
+create table linkchecks (linkid integer primary key, status integer, location text, checked text, brokensince text);
+create table snapshots (snapshotid integer primary key, linkid integer, hash text, size integer, mime text, url text, dt text);
+create table blocks (blockid integer primary key, name text, dt text);
+create table reactions (reactionid integer primary key, linkid integer, kind text, actor text, xid text, dt text);
+create table replies (replyid integer primary key, linkid integer, xid text, actor text, url text, content text, dt text, hidden integer);
+create table images (name text primary key, mediatype text, data blob, hash text, dt text);
+create table inboxes (rcpt text primary key, firstfail text, dead integer);
+
+create trigger linktext_insert after insert on linktext begin insert into linksearch (rowid, title, summary, remnants) values (new.docid, new.title, new.summary, new.remnants); end;
+create trigger linktext_delete after delete on linktext begin insert into linksearch (linksearch, rowid, title, summary, remnants) values ('delete', old.docid, old.title, old.summary, old.remnants); end;
+create trigger linktext_update after update on linktext begin insert into linksearch (linksearch, rowid, title, summary, remnants) values ('delete', old.docid, old.title, old.summary, old.remnants); insert into linksearch (rowid, title, summary, remnants) values (new.docid, new.title, new.summary, new.remnants); end;
 
 create index idx_linkstextid on links(textid);
 create index idx_linkssite on links(site);
 create index idx_linkssource on links(source);
+create index idx_linksurl on links(url);
+create index idx_linkscanonical on links(canonical);
+create index idx_linksdt on links(dt);
+create index idx_snapshotslinkid on snapshots(linkid);
 create index idx_tagstag on tags(tag);
 create index idx_tagslinkid on tags(linkid);
+create index idx_deliveriesnextdt on deliveries(nextdt);
+create index idx_reactionslinkid on reactions(linkid);
+create index idx_replieslinkid on replies(linkid);
+create index idx_linkcollectionslinkid on linkcollections(linkid);
+create index idx_linkcollectionscollectionid on linkcollections(collectionid);
 
 CREATE TABLE config (key text, value text);
 
-CREATE TABLE users (userid integer primary key, username text, hash text);
+CREATE TABLE users (userid integer primary key, username text, hash text, role text);
 CREATE TABLE auth (authid integer primary key, userid integer, hash text, expiry text);
 CREATE INDEX idxusers_username on users(username);
 CREATE INDEX idxauth_userid on auth(userid);
 CREATE INDEX idxauth_hash on auth(hash);
+CREATE TABLE apitokens (tokenid integer primary key, userid integer, name text, hash text, dt text);
+CREATE INDEX idxapitokens_hash on apitokens(hash);
 
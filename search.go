@@ -0,0 +1,322 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A search is words and "phrases", all of which must match, with OR
+// between two of them to take either. A word ending in * matches
+// words starting with it. title: looks only at titles.
+// tag:, site:, and source: pick links, a leading - leaves them out,
+// as it does for words. before: and after: take a day, 2006-01-02.
+// sort:best orders by relevance instead of newest first.
+type searchquery struct {
+	Match      string
+	Exclude    []string
+	Tags       []string
+	NotTags    []string
+	Sites      []string
+	NotSites   []string
+	Sources    []string
+	NotSources []string
+	Before     string
+	After      string
+	Best       bool
+}
+
+type searchterm struct {
+	not   bool
+	field string
+	text  string
+}
+
+// splitquery breaks a search into terms, keeping quoted phrases whole
+func splitquery(s string) []searchterm {
+	var terms []searchterm
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+		var t searchterm
+		if s[0] == '-' {
+			t.not = true
+			s = s[1:]
+		}
+		if i := strings.IndexAny(s, ":\" \t\r\n"); i > 0 && s[i] == ':' {
+			t.field = strings.ToLower(s[:i])
+			s = s[i+1:]
+		}
+		if s != "" && s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				t.text, s = s[1:], ""
+			} else {
+				t.text, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(s, " \t\r\n")
+			if end == -1 {
+				end = len(s)
+			}
+			t.text, s = s[:end], s[end:]
+		}
+		terms = append(terms, t)
+	}
+	return terms
+}
+
+var re_searchword = regexp.MustCompile(`[\pL\pN_]+`)
+
+// ftsphrase quotes some text so it can only ever be a phrase to match,
+// or the start of one
+func ftsphrase(s string) string {
+	prefix := strings.HasSuffix(s, "*")
+	s = strings.TrimRight(s, "*")
+	if !re_searchword.MatchString(s) {
+		return ""
+	}
+	words := strings.Fields(strings.Replace(s, `"`, " ", -1))
+	phrase := `"` + strings.Join(words, " ") + `"`
+	if prefix {
+		phrase += "*"
+	}
+	return phrase
+}
+
+func parsequery(s string) *searchquery {
+	q := new(searchquery)
+	var match []string
+	// an OR waits for a word on each side
+	or := false
+	for _, t := range splitquery(s) {
+		if t.field == "" && !t.not && t.text == "OR" {
+			or = len(match) > 0
+			continue
+		}
+		phrase := ""
+		switch t.field {
+		case "tag":
+			tag := strings.TrimSpace(t.text)
+			if tag == "" {
+				break
+			}
+			if t.not {
+				q.NotTags = append(q.NotTags, tag)
+			} else {
+				q.Tags = append(q.Tags, tag)
+			}
+		case "site":
+			site := strings.ToLower(strings.TrimSpace(t.text))
+			if site == "" {
+				break
+			}
+			if t.not {
+				q.NotSites = append(q.NotSites, site)
+			} else {
+				q.Sites = append(q.Sites, site)
+			}
+		case "source":
+			source := strings.TrimSpace(t.text)
+			if source == "" {
+				break
+			}
+			if t.not {
+				q.NotSources = append(q.NotSources, source)
+			} else {
+				q.Sources = append(q.Sources, source)
+			}
+		case "before", "after":
+			day, err := time.Parse("2006-01-02", t.text)
+			if err != nil {
+				break
+			}
+			if t.field == "before" {
+				q.Before = day.Format(dbtimeformat)
+			} else {
+				q.After = day.AddDate(0, 0, 1).Format(dbtimeformat)
+			}
+		case "sort":
+			q.Best = t.text == "best"
+		case "title":
+			if p := ftsphrase(t.text); p != "" {
+				phrase = "title:" + p
+			}
+		default:
+			text := t.text
+			if t.field != "" {
+				text = t.field + " " + text
+			}
+			phrase = ftsphrase(text)
+		}
+		if phrase == "" {
+			continue
+		}
+		if t.not {
+			q.Exclude = append(q.Exclude, phrase)
+			continue
+		}
+		if or {
+			match = append(match, "OR")
+			or = false
+		}
+		match = append(match, phrase)
+	}
+	q.Match = strings.Join(match, " ")
+	return q
+}
+
+// subdomains are matched with like, which mustn't see wildcards
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// where turns the query into conditions and their args
+func (q *searchquery) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if q.Match != "" {
+		conds = append(conds, "linksearch match ?")
+		args = append(args, q.Match)
+	}
+	for _, x := range q.Exclude {
+		conds = append(conds, "textid not in (select rowid from linksearch where linksearch match ?)")
+		args = append(args, x)
+	}
+	for _, tag := range q.Tags {
+		conds = append(conds, "linkid in (select linkid from tags where tag = ?)")
+		args = append(args, tag)
+	}
+	for _, tag := range q.NotTags {
+		conds = append(conds, "linkid not in (select linkid from tags where tag = ?)")
+		args = append(args, tag)
+	}
+	if len(q.Sites) > 0 {
+		var either []string
+		for _, site := range q.Sites {
+			either = append(either, `site = ? or site like ? escape '\'`)
+			args = append(args, site, "%."+likeEscaper.Replace(site))
+		}
+		conds = append(conds, "("+strings.Join(either, " or ")+")")
+	}
+	for _, site := range q.NotSites {
+		conds = append(conds, `not (site = ? or site like ? escape '\')`)
+		args = append(args, site, "%."+likeEscaper.Replace(site))
+	}
+	if len(q.Sources) > 0 {
+		conds = append(conds, "source in (?"+strings.Repeat(", ?", len(q.Sources)-1)+")")
+		for _, source := range q.Sources {
+			args = append(args, source)
+		}
+	}
+	for _, source := range q.NotSources {
+		conds = append(conds, "source != ?")
+		args = append(args, source)
+	}
+	if q.Before != "" {
+		conds = append(conds, "dt < ?")
+		args = append(args, q.Before)
+	}
+	if q.After != "" {
+		conds = append(conds, "dt >= ?")
+		args = append(args, q.After)
+	}
+	return strings.Join(conds, " and "), args
+}
+
+func (q *searchquery) empty() bool {
+	where, _ := q.where()
+	return where == ""
+}
+
+// titles count for more than summaries, which count for more than
+// the text of the page
+var searchRank = "bm25(linksearch, 4.0, 2.0, 1.0)"
+
+func searchlinks(search string, lastlink int64, maxvis int) ([]*Link, int64) {
+	q := parsequery(search)
+	if q.empty() {
+		return nil, 0
+	}
+	where, args := q.where()
+	log.Printf("searching for '%s' where %s", search, where)
+	query := "select linkid, url, dt, source, site, linktext.title, linktext.summary, visibility from links join linktext on links.textid = linktext.docid"
+	if q.Match != "" {
+		query += " join linksearch on linksearch.rowid = links.textid"
+	}
+	query += " where " + where + " and (dt, linkid) < (select ifnull(max(dt), '9999'), ifnull(max(linkid), 0) from links where linkid = ?) and visibility <= ?"
+	if q.Best && q.Match != "" {
+		query += " order by " + searchRank
+	} else {
+		query += " order by dt desc, linkid desc"
+	}
+	query += " limit 20"
+	args = append(args, lastlink, maxvis)
+	rows, err := opendatabase().Query(query, args...)
+	links, lastlink := readlinks(rows, err)
+	if q.Match != "" {
+		snippetlinks(links, q.Match)
+	}
+	if q.Best {
+		// ranked results don't page
+		lastlink = 0
+	}
+	return links, lastlink
+}
+
+// snippets come back from sqlite with these around the matches
+const snipStart, snipEnd = "\x02", "\x03"
+
+// snippetlinks fills in the matching bits of each link
+func snippetlinks(links []*Link, match string) {
+	if len(links) == 0 {
+		return
+	}
+	var ids []string
+	lmap := make(map[int64]*Link)
+	for _, l := range links {
+		ids = append(ids, fmt.Sprintf("%d", l.ID))
+		lmap[l.ID] = l
+	}
+	q := fmt.Sprintf("select linkid, snippet(linksearch, -1, ?, ?, ?, 16) from links join linksearch on linksearch.rowid = links.textid where linksearch match ? and linkid in (%s)", strings.Join(ids, ","))
+	rows, err := opendatabase().Query(q, snipStart, snipEnd, "…", match)
+	if err != nil {
+		log.Printf("can't load snippets: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lid int64
+		var snip string
+		err = rows.Scan(&lid, &snip)
+		if err != nil {
+			log.Printf("can't scan snippet: %s", err)
+			continue
+		}
+		if strings.Contains(snip, snipStart) {
+			snip = html.EscapeString(snip)
+			snip = strings.Replace(snip, snipStart, "<mark>", -1)
+			snip = strings.Replace(snip, snipEnd, "</mark>", -1)
+			lmap[lid].Snippet = template.HTML(snip)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		in  string
+		out searchquery
+	}{
+		{"", searchquery{}},
+		{"hello", searchquery{Match: `"hello"`}},
+		{"hello world", searchquery{Match: `"hello" "world"`}},
+		{`"hello world" again`, searchquery{Match: `"hello world" "again"`}},
+		{`"unfinished phrase`, searchquery{Match: `"unfinished phrase"`}},
+		{`""`, searchquery{}},
+		{"go OR rust", searchquery{Match: `"go" OR "rust"`}},
+		{"OR go OR", searchquery{Match: `"go"`}},
+		{"go OR OR rust", searchquery{Match: `"go" OR "rust"`}},
+		{"or", searchquery{Match: `"or"`}},
+		{"-excluded kept", searchquery{Match: `"kept"`, Exclude: []string{`"excluded"`}}},
+		{`-"two words"`, searchquery{Exclude: []string{`"two words"`}}},
+		{"go OR -java", searchquery{Match: `"go"`, Exclude: []string{`"java"`}}},
+		{"title:kernel", searchquery{Match: `title:"kernel"`}},
+		{`title:"Linux kernel" news`, searchquery{Match: `title:"Linux kernel" "news"`}},
+		{"title:OR", searchquery{Match: `title:"OR"`}},
+		{"title:-", searchquery{}},
+		{"-title:boring", searchquery{Exclude: []string{`title:"boring"`}}},
+		{"kern*", searchquery{Match: `"kern"*`}},
+		{"title:kern* -old*", searchquery{Match: `title:"kern"*`, Exclude: []string{`"old"*`}}},
+		{`"linux kern"*`, searchquery{Match: `"linux kern"`}},
+		{`"linux kern*"`, searchquery{Match: `"linux kern"*`}},
+		{"* **", searchquery{}},
+		{"tag:go", searchquery{Tags: []string{"go"}}},
+		{"tag:go -tag:rust", searchquery{Tags: []string{"go"}, NotTags: []string{"rust"}}},
+		{"site:lwn.net kernel", searchquery{Match: `"kernel"`, Sites: []string{"lwn.net"}}},
+		{"site:LWN.net -site:example.com", searchquery{Sites: []string{"lwn.net"}, NotSites: []string{"example.com"}}},
+		{"source:alice", searchquery{Sources: []string{"alice"}}},
+		{`source:"alice b"`, searchquery{Sources: []string{"alice b"}}},
+		{"-source:bob", searchquery{NotSources: []string{"bob"}}},
+		{"before:2020-01-01", searchquery{Before: "2020-01-01 00:00:00"}},
+		{"after:2020-01-01", searchquery{After: "2020-01-02 00:00:00"}},
+		{"before:yesterday", searchquery{}},
+		{"sort:best go", searchquery{Match: `"go"`, Best: true}},
+		{"sort:new go", searchquery{Match: `"go"`}},
+		{"tag:", searchquery{}},
+		{"foo:bar", searchquery{Match: `"foo bar"`}},
+		{"http://example.com", searchquery{Match: `"http //example.com"`}},
+		{`NEAR* (x) AND y`, searchquery{Match: `"NEAR"* "(x)" "AND" "y"`}},
+		{`say "it's \"fine\""`, searchquery{Match: `"say" "it's \" "fine\"`}},
+		{"  spaced \t out  ", searchquery{Match: `"spaced" "out"`}},
+		{"-", searchquery{}},
+		{"Tag:Go", searchquery{Tags: []string{"Go"}}},
+	}
+	for _, test := range tests {
+		q := parsequery(test.in)
+		if !reflect.DeepEqual(*q, test.out) {
+			t.Errorf("parsequery(%q)\nresult: %+v\nexpected: %+v", test.in, *q, test.out)
+		}
+	}
+}
+
+func TestQueryWhere(t *testing.T) {
+	tests := []struct {
+		in    string
+		where string
+		args  []interface{}
+	}{
+		{"", "", nil},
+		{"go", "linksearch match ?", []interface{}{`"go"`}},
+		{"-go", "textid not in (select rowid from linksearch where linksearch match ?)", []interface{}{`"go"`}},
+		{"tag:a -tag:b", "linkid in (select linkid from tags where tag = ?) and linkid not in (select linkid from tags where tag = ?)",
+			[]interface{}{"a", "b"}},
+		{"site:a.com site:b.org", `(site = ? or site like ? escape '\' or site = ? or site like ? escape '\')`,
+			[]interface{}{"a.com", "%.a.com", "b.org", "%.b.org"}},
+		{"-site:my_site.com", `not (site = ? or site like ? escape '\')`,
+			[]interface{}{"my_site.com", `%.my\_site.com`}},
+		{"site:%", `(site = ? or site like ? escape '\')`,
+			[]interface{}{"%", `%.\%`}},
+		{"source:a source:b -source:c", "source in (?, ?) and source != ?", []interface{}{"a", "b", "c"}},
+		{"after:2020-01-01 before:2021-01-01", "dt < ? and dt >= ?",
+			[]interface{}{"2021-01-01 00:00:00", "2020-01-02 00:00:00"}},
+	}
+	for _, test := range tests {
+		where, args := parsequery(test.in).where()
+		if where != test.where || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("where(%q)\nresult: %s %v\nexpected: %s %v", test.in, where, args, test.where, test.args)
+		}
+	}
+}
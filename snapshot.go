@@ -0,0 +1,325 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Snapshots are single file copies of a page, with stylesheets and
+// images folded in, stored by hash under snapshots next to the database.
+
+var snapshots = false
+var snapshotLimit int64 = 5 * 1024 * 1024
+
+// the most stylesheets and images fetched for one page
+var snapshotAssets = 50
+var snapshotTypes = []string{"text/html", "application/xhtml+xml", "text/plain",
+	"application/pdf", "text/css", "image/png", "image/jpeg", "image/gif", "image/webp"}
+var snapshotq = make(chan int64, 1000)
+
+var snapshotCSP = "default-src 'none'; img-src data:; style-src 'unsafe-inline' data:; " +
+	"font-src data:; media-src data:; sandbox"
+
+func snapshotconfig() {
+	getconfig("snapshots", &snapshots)
+	getconfig("snapshotlimit", &snapshotLimit)
+	var types string
+	getconfig("snapshottypes", &types)
+	if types != "" {
+		snapshotTypes = strings.Fields(types)
+	}
+}
+
+func snapshotdir() string {
+	return filepath.Join(filepath.Dir(dbname), "snapshots")
+}
+
+func snapshotpath(hash string) string {
+	return filepath.Join(snapshotdir(), hash[:2], hash)
+}
+
+// storeblob saves data under its hash, once
+func storeblob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	fname := snapshotpath(hash)
+	if _, err := os.Stat(fname); err == nil {
+		return hash, nil
+	}
+	err := os.MkdirAll(filepath.Dir(fname), 0700)
+	if err != nil {
+		return "", err
+	}
+	tmp := fname + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, fname)
+}
+
+var re_script = regexp.MustCompile(`(?is)<script\b.*?</script\s*>`)
+var re_basetag = regexp.MustCompile(`(?is)<base\b[^>]*>`)
+var re_linktag = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+var re_imgtag = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+var re_srcattr = regexp.MustCompile(`(?is)\s(src|srcset|data-src|data-srcset)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+
+// inlinepage folds a page's stylesheets and images into it.
+// Anything that doesn't fit in what's left of the limit is left out,
+// as is everything past the first so many assets.
+func inlinepage(page string, base *url.URL) string {
+	page = re_script.ReplaceAllString(page, "")
+	page = re_basetag.ReplaceAllString(page, "")
+	budget := snapshotLimit - int64(len(page))
+	fetches := 0
+	fetchasset := func(ref string) ([]byte, string, bool) {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || budget <= 0 || fetches >= snapshotAssets {
+			return nil, "", false
+		}
+		fetches++
+		data, _, ct, err := fetchpage(u.String(), budget, snapshotTypes)
+		if err != nil {
+			log.Printf("can't fetch snapshot asset %s: %s", u, err)
+			return nil, "", false
+		}
+		budget -= int64(len(data))
+		return data, ct, true
+	}
+	page = re_linktag.ReplaceAllStringFunc(page, func(tag string) string {
+		attrs := tagattrs(tag)
+		if !strings.Contains(strings.ToLower(attrs["rel"]), "stylesheet") || attrs["href"] == "" {
+			return tag
+		}
+		data, ct, ok := fetchasset(attrs["href"])
+		if !ok || ct != "text/css" {
+			return ""
+		}
+		css := strings.Replace(string(data), "</", `<\/`, -1)
+		return "<style>" + css + "</style>"
+	})
+	page = re_imgtag.ReplaceAllStringFunc(page, func(tag string) string {
+		attrs := tagattrs(tag)
+		src := attrs["src"]
+		if src == "" || strings.HasPrefix(src, "data:") {
+			src = attrs["data-src"]
+		}
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return tag
+		}
+		tag = re_srcattr.ReplaceAllString(tag, "")
+		data, ct, ok := fetchasset(src)
+		if !ok || !strings.HasPrefix(ct, "image/") {
+			return tag
+		}
+		datauri := "data:" + ct + ";base64," + base64.StdEncoding.EncodeToString(data)
+		return tag[:4] + ` src="` + datauri + `"` + tag[4:]
+	})
+	return page
+}
+
+// takesnapshot saves a copy of the link's page as it is now
+func takesnapshot(link *Link) error {
+	data, final, ct, err := fetchpage(link.URL, snapshotLimit, snapshotTypes)
+	if err == errFetchTooBig {
+		return fmt.Errorf("page larger than %d bytes", snapshotLimit)
+	}
+	if err != nil {
+		return err
+	}
+	if ct == "text/html" || ct == "application/xhtml+xml" {
+		base, _ := url.Parse(final)
+		page := inlinepage(string(data), base)
+		data = []byte(fmt.Sprintf("<!-- snapshot of %s -->\n", final) + page)
+	}
+	hash, err := storeblob(data)
+	if err != nil {
+		return err
+	}
+	var lasthash string
+	row := stmtGetSnapshot.QueryRow(link.ID)
+	row.Scan(&lasthash, new(string))
+	if hash == lasthash {
+		return nil
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	_, err = stmtSaveSnapshot.Exec(link.ID, hash, len(data), ct, final, dt)
+	return err
+}
+
+func queuesnapshot(linkid int64) {
+	if !snapshots {
+		return
+	}
+	select {
+	case snapshotq <- linkid:
+	default:
+		log.Printf("snapshot queue full, skipping %d", linkid)
+	}
+}
+
+func snapshotter() {
+	for linkid := range snapshotq {
+		link := oneLink(linkid)
+		if link == nil {
+			continue
+		}
+		err := takesnapshot(link)
+		if err != nil {
+			log.Printf("error taking snapshot of %d: %s", linkid, err)
+		}
+	}
+}
+
+func showsnapshot(w http.ResponseWriter, r *http.Request) {
+	linkid, _ := strconv.ParseInt(mux.Vars(r)["linkid"], 10, 0)
+	link := oneLink(linkid)
+	if link == nil || link.Queued() || (visibility(link.Visibility) > maxvisibility(r) &&
+		visibility(link.Visibility) != visUnlisted) {
+		http.NotFound(w, r)
+		return
+	}
+	var hash, ct string
+	row := stmtGetSnapshot.QueryRow(linkid)
+	err := row.Scan(&hash, &ct)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fd, err := os.Open(snapshotpath(hash))
+	if err != nil {
+		log.Printf("missing snapshot %s: %s", hash, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer fd.Close()
+	w.Header().Set("Content-Security-Policy", snapshotCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", time.Time{}, fd)
+}
+
+// cleansnapshots removes files no snapshot refers to anymore
+func cleansnapshots() {
+	db := opendatabase()
+	rows, err := db.Query("select distinct hash from snapshots")
+	if err != nil {
+		log.Fatal(err)
+	}
+	keep := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		rows.Scan(&hash)
+		keep[hash] = true
+	}
+	rows.Close()
+	removed := 0
+	filepath.Walk(snapshotdir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || keep[info.Name()] {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Printf("can't remove %s: %s", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	fmt.Printf("removed %d files\n", removed)
+}
+
+func snapshotcmd(args []string) {
+	if len(args) < 1 {
+		log.Fatal("need an argument: snapshot (linkid|all|limit|types|cleanup)")
+	}
+	db := opendatabase()
+	prepareStatements(db)
+	snapshotconfig()
+	switch args[0] {
+	case "limit":
+		if len(args) != 2 {
+			log.Fatal("need an argument: snapshot limit bytes")
+		}
+		limit, err := strconv.ParseInt(args[1], 10, 0)
+		if err != nil || limit < 1 {
+			log.Fatal("limit must be a number of bytes")
+		}
+		setconfig("snapshotlimit", limit)
+	case "types":
+		if len(args) < 2 {
+			log.Fatal("need an argument: snapshot types mimetype...")
+		}
+		setconfig("snapshottypes", strings.Join(args[1:], " "))
+	case "cleanup":
+		cleansnapshots()
+	case "all":
+		rows, err := db.Query("select linkid from links where linkid not in (select linkid from snapshots) order by linkid")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var linkids []int64
+		for rows.Next() {
+			var linkid int64
+			rows.Scan(&linkid)
+			linkids = append(linkids, linkid)
+		}
+		rows.Close()
+		for _, linkid := range linkids {
+			link := oneLink(linkid)
+			if link == nil {
+				continue
+			}
+			err = takesnapshot(link)
+			if err != nil {
+				log.Printf("error taking snapshot of %d: %s", linkid, err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	default:
+		linkid, _ := strconv.ParseInt(args[0], 10, 0)
+		link := oneLink(linkid)
+		if link == nil {
+			log.Fatalf("no such link: %s", args[0])
+		}
+		err := takesnapshot(link)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var hash, ct string
+		stmtGetSnapshot.QueryRow(linkid).Scan(&hash, &ct)
+		fmt.Printf("%s %s\n", hash, ct)
+	}
+}
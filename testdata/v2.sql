@@ -0,0 +1,38 @@
+
+create table links(linkid integer primary key, textid integer, url text, dt text, source text, site text);
+create virtual table linktext using fts4 (title, summary, remnants);
+create table tags (tagid integer primary key, linkid integer, tag text);
+create table sources (sourceid integer primary key, name text, notes text);
+
+create table followers(followerid integer primary key, url text);
+
+create index idx_linkstextid on links(textid);
+create index idx_linkssite on links(site);
+create index idx_linkssource on links(source);
+create index idx_tagstag on tags(tag);
+create index idx_tagslinkid on tags(linkid);
+
+CREATE TABLE config (key text, value text);
+
+CREATE TABLE users (userid integer primary key, username text, hash text);
+CREATE TABLE auth (authid integer primary key, userid integer, hash text, expiry text);
+CREATE INDEX idxusers_username on users(username);
+CREATE INDEX idxauth_userid on auth(userid);
+CREATE INDEX idxauth_hash on auth(hash);
+
+
+insert into config (key, value) values ('dbversion', 2);
+insert into users (userid, username, hash) values (1, 'inks', 'x');
+insert into linktext (docid, title, summary, remnants) values (1, 'Linux kernel news', 'what the kernel people did', '');
+insert into linktext (docid, title, summary, remnants) values (2, 'Deleted', 'gone', '');
+insert into linktext (docid, title, summary, remnants) values (5, 'Go generics', 'types for go', 'the kernel of the idea');
+insert into linktext (docid, title, summary, remnants) values (6, 'Rust', 'kernels and drivers in rust', '');
+delete from linktext where docid = 2;
+insert into links (linkid, textid, url, dt, source, site) values (1, 1, 'https://lwn.net/a', '2019-03-01 10:00:00', 'alice', 'lwn.net');
+insert into links (linkid, textid, url, dt, source, site) values (2, 6, 'https://example.com/rust?utm_source=x', '2019-04-01 10:00:00', '', 'example.com');
+insert into links (linkid, textid, url, dt, source, site) values (3, 5, 'https://go.dev/blog', '2019-05-01 10:00:00', 'bob', 'go.dev');
+insert into tags (linkid, tag) values (1, 'linux');
+insert into tags (linkid, tag) values (2, 'rust');
+insert into tags (linkid, tag) values (3, 'go');
+insert into sources (name, notes) values ('alice', 'reads lwn');
+insert into followers (url) values ('https://social.example/u/carol');
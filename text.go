@@ -78,3 +78,75 @@ func prettyquotes(s string) string {
 
 	return s
 }
+
+var re_badtag = regexp.MustCompile(`[^[:alnum:].-]+`)
+
+// cleantag turns a foreign tag into one that fits in a tag url
+func cleantag(tag string) string {
+	return strings.Trim(re_badtag.ReplaceAllString(strings.ToLower(tag), "-"), "-")
+}
+
+var re_junkblocks []*regexp.Regexp
+var re_comment = regexp.MustCompile(`(?s)<!--.*?-->`)
+var re_body = regexp.MustCompile(`(?is)<body[^>]*>(.*)`)
+var re_article = regexp.MustCompile(`(?is)<(article|main)[\s>].*?</(article|main)>`)
+var re_blockend = regexp.MustCompile(`(?i)</?(p|div|li|ul|ol|h[1-6]|pre|blockquote|section|table|tr|dd|dt|figcaption)\b[^>]*>`)
+var re_anchor = regexp.MustCompile(`(?is)<a\b[^>]*>(.*?)</a>`)
+var re_anytag = regexp.MustCompile(`(?s)<[^>]*>`)
+
+func init() {
+	for _, tag := range []string{"script", "style", "noscript", "template", "svg",
+		"nav", "header", "footer", "aside", "form", "iframe", "button", "select"} {
+		re := regexp.MustCompile(`(?is)<` + tag + `\b.*?</` + tag + `\s*>`)
+		re_junkblocks = append(re_junkblocks, re)
+	}
+}
+
+// readabletext extracts the main text of a page, roughly how a reader
+// view would, skipping navigation and paragraphs that are mostly links.
+func readabletext(page string) string {
+	if m := re_body.FindStringSubmatch(page); m != nil {
+		page = m[1]
+	}
+	page = re_comment.ReplaceAllString(page, "")
+	for _, re := range re_junkblocks {
+		page = re.ReplaceAllString(page, " ")
+	}
+	best := ""
+	for _, a := range re_article.FindAllString(page, -1) {
+		if len(a) > len(best) {
+			best = a
+		}
+	}
+	if len(best) > len(page)/4 {
+		page = best
+	}
+
+	var paras []string
+	for _, block := range re_blockend.Split(page, -1) {
+		linktext := 0
+		for _, m := range re_anchor.FindAllStringSubmatch(block, -1) {
+			linktext += len(strings.Fields(re_anytag.ReplaceAllString(m[1], " ")))
+		}
+		words := strings.Fields(html.UnescapeString(re_anytag.ReplaceAllString(block, " ")))
+		if len(words) < 4 || linktext*2 > len(words) {
+			continue
+		}
+		paras = append(paras, strings.Join(words, " "))
+	}
+	return strings.Join(paras, "\n")
+}
+
+var re_linebreak = regexp.MustCompile(`(?i)<br\s*/?>`)
+
+// plaintext turns a bit of foreign html, like a reply, back into text
+func plaintext(s string) string {
+	s = re_linebreak.ReplaceAllString(s, "\n")
+	s = re_blockend.ReplaceAllString(s, "\n\n")
+	s = html.UnescapeString(re_anytag.ReplaceAllString(s, ""))
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
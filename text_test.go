@@ -37,3 +37,27 @@ feature three</blockquote>
 		t.Errorf("failure.\nresult: %s\nexpected: %s\n", rv, out)
 	}
 }
+
+func TestReadable(t *testing.T) {
+	in := `<html><head><title>t</title><style>p { color: red }</style></head>
+<body>
+<nav><a href="/">home</a> <a href="/about">about us and more</a></nav>
+<div class="menu"><a href="/1">one link here</a> <a href="/2">two link here</a></div>
+<article>
+<h1>The headline of the story</h1>
+<p>The first paragraph has <a href="/x">a link</a> and some words &amp; more.
+<script>var x = "not text at all";</script>
+<p>Short.
+<p>The second paragraph<br>spans two lines of text.
+</article>
+<footer>copyright somebody forever and ever</footer>
+</body></html>`
+
+	out := `The headline of the story
+The first paragraph has a link and some words & more.
+The second paragraph spans two lines of text.`
+	rv := readabletext(in)
+	if rv != out {
+		t.Errorf("failure.\nresult: %s\nexpected: %s\n", rv, out)
+	}
+}
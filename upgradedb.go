@@ -21,9 +21,13 @@ import (
 	"os"
 )
 
-var dbVersion = 2
+var dbVersion = 18
 
-func doordie(db *sql.DB, s string, args ...interface{}) {
+type execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+func doordie(db execer, s string, args ...interface{}) {
 	_, err := db.Exec(s, args...)
 	if err != nil {
 		log.Fatalf("can't run %s: %s", s, err)
@@ -34,7 +38,11 @@ func upgradedb() {
 	db := opendatabase()
 	ver := 0
 	getconfig("dbversion", &ver)
+	upgrade(db, ver)
+	os.Exit(0)
+}
 
+func upgrade(db *sql.DB, ver int) {
 	switch ver {
 	case 0:
 		doordie(db, "drop table auth")
@@ -47,9 +55,111 @@ func upgradedb() {
 		doordie(db, "update config set value = 2 where key = 'dbversion'")
 		fallthrough
 	case 2:
+		doordie(db, "create table tombstones (linkid integer primary key, dt text)")
+		doordie(db, "update config set value = 3 where key = 'dbversion'")
+		fallthrough
+	case 3:
+		doordie(db, "CREATE TABLE apitokens (tokenid integer primary key, userid integer, name text, hash text, dt text)")
+		doordie(db, "CREATE INDEX idxapitokens_hash on apitokens(hash)")
+		doordie(db, "update config set value = 4 where key = 'dbversion'")
+		fallthrough
+	case 4:
+		doordie(db, "create index idx_linksurl on links(url)")
+		doordie(db, "update config set value = 5 where key = 'dbversion'")
+		fallthrough
+	case 5:
+		doordie(db, "create table deliveries (dlid integer primary key, rcpt text, host text, msg blob, tries integer, dt text, nextdt text, lasterr text)")
+		doordie(db, "create table inboxes (rcpt text primary key, firstfail text, dead integer)")
+		doordie(db, "create index idx_deliveriesnextdt on deliveries(nextdt)")
+		doordie(db, "update config set value = 6 where key = 'dbversion'")
+		fallthrough
+	case 6:
+		doordie(db, "alter table followers add column dt text")
+		doordie(db, "alter table followers add column inbox text")
+		doordie(db, "update config set value = 7 where key = 'dbversion'")
+		fallthrough
+	case 7:
+		doordie(db, "create table pending (pendingid integer primary key, actor text, dt text, req text)")
+		doordie(db, "create table blocks (blockid integer primary key, name text, dt text)")
+		doordie(db, "update config set value = 8 where key = 'dbversion'")
+		fallthrough
+	case 8:
+		doordie(db, "create table reactions (reactionid integer primary key, linkid integer, kind text, actor text, xid text, dt text)")
+		doordie(db, "create table replies (replyid integer primary key, linkid integer, xid text, actor text, url text, content text, dt text, hidden integer)")
+		doordie(db, "create index idx_reactionslinkid on reactions(linkid)")
+		doordie(db, "create index idx_replieslinkid on replies(linkid)")
+		doordie(db, "update config set value = 9 where key = 'dbversion'")
+		fallthrough
+	case 9:
+		doordie(db, "create table images (name text primary key, mediatype text, data blob, hash text, dt text)")
+		doordie(db, "update config set value = 10 where key = 'dbversion'")
+		fallthrough
+	case 10:
+		doordie(db, "create table collections (collectionid integer primary key, name text, title text, dt text)")
+		doordie(db, "create table linkcollections (linkid integer, collectionid integer, dt text, announced integer)")
+		doordie(db, "create index idx_linkcollectionslinkid on linkcollections(linkid)")
+		doordie(db, "create index idx_linkcollectionscollectionid on linkcollections(collectionid)")
+		doordie(db, "alter table followers add column collectionid integer default 0")
+		doordie(db, "alter table pending add column collectionid integer default 0")
+		doordie(db, "update config set value = 11 where key = 'dbversion'")
+		fallthrough
+	case 11:
+		// everybody could do everything before
+		doordie(db, "alter table users add column role text default 'admin'")
+		doordie(db, "alter table links add column userid integer default 0")
+		doordie(db, "update links set userid = (select min(userid) from users)")
+		doordie(db, "update config set value = 12 where key = 'dbversion'")
+		fallthrough
+	case 12:
+		doordie(db, "alter table links add column visibility integer default 0")
+		doordie(db, "update config set value = 13 where key = 'dbversion'")
+		fallthrough
+	case 13:
+		doordie(db, "create table queue (linkid integer primary key, publishdt text, visibility integer, pos integer)")
+		// lists go by date, so published drafts come out on top
+		doordie(db, "create index idx_linksdt on links(dt)")
+		doordie(db, "update config set value = 14 where key = 'dbversion'")
+		fallthrough
+	case 14:
+		doordie(db, "alter table links add column canonical text")
+		fillcanonical(db)
+		doordie(db, "create index idx_linkscanonical on links(canonical)")
+		doordie(db, "update config set value = 15 where key = 'dbversion'")
+		fallthrough
+	case 15:
+		doordie(db, "create table linkchecks (linkid integer primary key, status integer, location text, checked text, brokensince text)")
+		doordie(db, "update config set value = 16 where key = 'dbversion'")
+		fallthrough
+	case 16:
+		doordie(db, "create table snapshots (snapshotid integer primary key, linkid integer, hash text, size integer, mime text, url text, dt text)")
+		doordie(db, "create index idx_snapshotslinkid on snapshots(linkid)")
+		doordie(db, "update config set value = 17 where key = 'dbversion'")
+		fallthrough
+	case 17:
+		// fts5 indexes the text kept in a plain table, docids unchanged.
+		// all or nothing, a half done swap would lose the text.
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatalf("can't begin upgrade: %s", err)
+		}
+		doordie(tx, "create table newtext (docid integer primary key, title text, summary text, remnants text)")
+		doordie(tx, "insert into newtext (docid, title, summary, remnants) select docid, title, summary, remnants from linktext")
+		doordie(tx, "drop table linktext")
+		doordie(tx, "alter table newtext rename to linktext")
+		doordie(tx, "create virtual table linksearch using fts5 (title, summary, remnants, content='linktext', content_rowid='docid', tokenize='porter unicode61', prefix='2 3')")
+		doordie(tx, "create trigger linktext_insert after insert on linktext begin insert into linksearch (rowid, title, summary, remnants) values (new.docid, new.title, new.summary, new.remnants); end")
+		doordie(tx, "create trigger linktext_delete after delete on linktext begin insert into linksearch (linksearch, rowid, title, summary, remnants) values ('delete', old.docid, old.title, old.summary, old.remnants); end")
+		doordie(tx, "create trigger linktext_update after update on linktext begin insert into linksearch (linksearch, rowid, title, summary, remnants) values ('delete', old.docid, old.title, old.summary, old.remnants); insert into linksearch (rowid, title, summary, remnants) values (new.docid, new.title, new.summary, new.remnants); end")
+		doordie(tx, "insert into linksearch (linksearch) values ('rebuild')")
+		doordie(tx, "update config set value = 18 where key = 'dbversion'")
+		err = tx.Commit()
+		if err != nil {
+			log.Fatalf("can't commit upgrade: %s", err)
+		}
+		fallthrough
+	case 18:
 
 	default:
 		log.Fatalf("can't upgrade unknown version %d", ver)
 	}
-	os.Exit(0)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadsql(t *testing.T, db *sql.DB, name string) {
+	err := runsql(db, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sqlitemaster(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query("select type || ' ' || name from sqlite_master where name not like 'sqlite_%' order by name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestUpgradeV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fresh, err := sql.Open("sqlite3", filepath.Join(dir, "fresh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadsql(t, fresh, "schema.sql")
+	want := sqlitemaster(t, fresh)
+	fresh.Close()
+
+	dbname = filepath.Join(dir, "inks.db")
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadsql(t, db, "testdata/v2.sql")
+	db.Close()
+	alreadyopendb = nil
+	db = opendatabase()
+	defer func() {
+		alreadyopendb.Close()
+		alreadyopendb = nil
+	}()
+
+	upgrade(db, 2)
+	ver := 0
+	getconfig("dbversion", &ver)
+	if ver != dbVersion {
+		t.Errorf("upgraded to version %d, not %d", ver, dbVersion)
+	}
+	if got := sqlitemaster(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("upgraded schema differs\nresult: %v\nexpected: %v", got, want)
+	}
+
+	prepareStatements(db)
+	// textids point at the same text as before
+	for linkid, title := range map[int64]string{1: "Linux kernel news", 2: "Rust", 3: "Go generics"} {
+		link := oneLink(linkid)
+		if link == nil || link.Title != title {
+			t.Errorf("link %d is %+v, wanted %s", linkid, link, title)
+		}
+	}
+	if linkid := findurl("http://example.com/rust"); linkid != 2 {
+		t.Errorf("canonical url found link %d", linkid)
+	}
+
+	search := func(q string) []int64 {
+		links, _ := searchlinks(q, 123456789012, visPrivate)
+		var ids []int64
+		for _, l := range links {
+			ids = append(ids, l.ID)
+		}
+		return ids
+	}
+	tests := []struct {
+		q   string
+		ids []int64
+	}{
+		{"kernel", []int64{3, 2, 1}},
+		{"kern*", []int64{3, 2, 1}},
+		{"title:kernel", []int64{1}},
+		{"kernel -rust", []int64{3, 1}},
+		{"kernel sort:best", []int64{1, 2, 3}},
+		{"gone", nil},
+	}
+	for _, test := range tests {
+		if ids := search(test.q); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("search %q found %v, wanted %v", test.q, ids, test.ids)
+		}
+	}
+	links, _ := searchlinks("drivers", 123456789012, visPrivate)
+	if len(links) != 1 || !strings.Contains(string(links[0].Snippet), "<mark>drivers</mark>") {
+		t.Errorf("no snippet for drivers: %+v", links)
+	}
+
+	// the index keeps up with new text, changed text, and deleted text
+	link := &Link{URL: "https://new.example/", Title: "Fresh", PlainSummary: "a new kernel"}
+	err = storelink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := search("fresh"); !reflect.DeepEqual(ids, []int64{link.ID}) {
+		t.Errorf("search for new link found %v", ids)
+	}
+	var textid int64
+	db.QueryRow("select textid from links where linkid = ?", link.ID).Scan(&textid)
+	if textid <= 6 {
+		t.Errorf("new link reused textid %d", textid)
+	}
+	stmtSaveRemnants.Exec("remnants about walruses", textid)
+	if ids := search("walrus*"); !reflect.DeepEqual(ids, []int64{link.ID}) {
+		t.Errorf("search for new text found %v", ids)
+	}
+	err = zaplink(link.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := search("walrus*"); ids != nil {
+		t.Errorf("search for deleted link found %v", ids)
+	}
+}
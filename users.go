@@ -0,0 +1,210 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// Admins run the place, editors post links and edit their own,
+// viewers can only look.
+var roles = map[string]int{
+	"viewer": 1,
+	"editor": 2,
+	"admin":  3,
+}
+
+type User struct {
+	ID   int64
+	Name string
+	Role string
+}
+
+func (u *User) Is(role string) bool {
+	return u != nil && roles[u.Role] >= roles[role]
+}
+
+// CanEdit says whether the user may change or delete a link
+func (u *User) CanEdit(link *Link) bool {
+	return u.Is("admin") || (u.Is("editor") && link.UserID == u.ID)
+}
+
+func getuserbyid(userid int64) *User {
+	u := new(User)
+	row := stmtGetUser.QueryRow(userid)
+	err := row.Scan(&u.ID, &u.Name, &u.Role)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+func getuser(r *http.Request) *User {
+	if u, ok := r.Context().Value(apiUserKey{}).(*User); ok {
+		return u
+	}
+	info := login.GetUserInfo(r)
+	if info == nil {
+		return nil
+	}
+	return getuserbyid(info.UserID)
+}
+
+type apiUserKey struct{}
+
+func withuser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiUserKey{}, u))
+}
+
+func finduser(name string) int64 {
+	var userid int64
+	row := opendatabase().QueryRow("select userid from users where username = ?", name)
+	row.Scan(&userid)
+	return userid
+}
+
+// roleRequired replaces login.Required for pages that need more than a login
+func roleRequired(role string, handler http.Handler) http.Handler {
+	return login.Required(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !getuser(r).Is(role) {
+			http.Error(w, "not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func adduser(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("need an argument: adduser username [admin|editor|viewer]")
+	}
+	name := args[0]
+	role := "editor"
+	if len(args) == 2 {
+		role = args[1]
+	}
+	if roles[role] == 0 {
+		log.Fatalf("unknown role: %s", role)
+	}
+	db := opendatabase()
+	if finduser(name) != 0 {
+		log.Fatalf("user %s already exists", name)
+	}
+	pass, err := askpassword(bufio.NewReader(os.Stdin))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), 12)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doordie(db, "insert into users (username, hash, role) values (?, ?, ?)", name, hash, role)
+}
+
+func deluser(args []string) {
+	if len(args) != 1 {
+		log.Fatal("need an argument: deluser username")
+	}
+	db := opendatabase()
+	var userid int64
+	var role string
+	row := db.QueryRow("select userid, role from users where username = ?", args[0])
+	err := row.Scan(&userid, &role)
+	if err != nil {
+		log.Fatalf("no such user: %s", args[0])
+	}
+	if role == "admin" && lastadmin() {
+		log.Fatal("can't delete the last admin")
+	}
+	// their links stay, without a curator
+	doordie(db, "update links set userid = 0 where userid = ?", userid)
+	doordie(db, "delete from auth where userid = ?", userid)
+	doordie(db, "delete from apitokens where userid = ?", userid)
+	doordie(db, "delete from users where userid = ?", userid)
+}
+
+func passwd(args []string) {
+	if len(args) != 1 {
+		log.Fatal("need an argument: passwd username")
+	}
+	db := opendatabase()
+	userid := finduser(args[0])
+	if userid == 0 {
+		log.Fatalf("no such user: %s", args[0])
+	}
+	pass, err := askpassword(bufio.NewReader(os.Stdin))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), 12)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doordie(db, "update users set hash = ? where userid = ?", hash, userid)
+	// log out everywhere
+	doordie(db, "delete from auth where userid = ?", userid)
+}
+
+func rolecmd(args []string) {
+	if len(args) != 2 || roles[args[1]] == 0 {
+		log.Fatal("need an argument: role username (admin|editor|viewer)")
+	}
+	db := opendatabase()
+	var userid int64
+	var role string
+	row := db.QueryRow("select userid, role from users where username = ?", args[0])
+	err := row.Scan(&userid, &role)
+	if err != nil {
+		log.Fatalf("no such user: %s", args[0])
+	}
+	if role == "admin" && args[1] != "admin" && lastadmin() {
+		log.Fatal("can't demote the last admin")
+	}
+	doordie(db, "update users set role = ? where userid = ?", args[1], userid)
+}
+
+func lastadmin() bool {
+	var admins int64
+	row := opendatabase().QueryRow("select count(*) from users where role = 'admin'")
+	row.Scan(&admins)
+	return admins < 2
+}
+
+func listusers() {
+	db := opendatabase()
+	rows, err := db.Query("select username, role, (select count(*) from links where links.userid = users.userid) from users order by username")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, role string
+		var cnt int64
+		err = rows.Scan(&name, &role, &cnt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\t%s\t%d\n", name, role, cnt)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"humungus.tedunangst.com/r/webs/templates"
+)
+
+func TestUserRoles(t *testing.T) {
+	admin := &User{ID: 1, Role: "admin"}
+	editor := &User{ID: 2, Role: "editor"}
+	viewer := &User{ID: 3, Role: "viewer"}
+	odd := &User{ID: 4, Role: "janitor"}
+	var nobody *User
+
+	tests := []struct {
+		user *User
+		role string
+		is   bool
+	}{
+		{admin, "admin", true},
+		{admin, "editor", true},
+		{admin, "viewer", true},
+		{editor, "admin", false},
+		{editor, "editor", true},
+		{editor, "viewer", true},
+		{viewer, "editor", false},
+		{viewer, "viewer", true},
+		{odd, "viewer", false},
+		{nobody, "viewer", false},
+	}
+	for _, test := range tests {
+		if is := test.user.Is(test.role); is != test.is {
+			t.Errorf("%+v.Is(%q) = %v, expected %v", test.user, test.role, is, test.is)
+		}
+	}
+
+	mine := &Link{UserID: 2}
+	theirs := &Link{UserID: 3}
+	orphan := &Link{UserID: 0}
+	edits := []struct {
+		user *User
+		link *Link
+		can  bool
+	}{
+		{admin, mine, true},
+		{admin, orphan, true},
+		{editor, mine, true},
+		{editor, theirs, false},
+		{editor, orphan, false},
+		{viewer, theirs, false},
+		{nobody, orphan, false},
+	}
+	for _, test := range edits {
+		if can := test.user.CanEdit(test.link); can != test.can {
+			t.Errorf("%+v.CanEdit(link by %d) = %v, expected %v", test.user, test.link.UserID, can, test.can)
+		}
+	}
+}
+
+func TestReplyModeration(t *testing.T) {
+	views := templates.Load(false, "views/header.html", "views/inks.html")
+	link := &Link{ID: 1, URL: "https://example.com/", Title: "example",
+		Reactions: &Reactions{Replies: []*Reply{{ID: 7, Actor: "https://social.example/u/a"}}}}
+	tests := []struct {
+		role string
+		info map[string]interface{}
+		form bool
+	}{
+		{"editor", map[string]interface{}{"SaveCSRF": "save", "DeleteCSRF": "delete"}, false},
+		{"admin", map[string]interface{}{"SaveCSRF": "save", "DeleteCSRF": "delete", "ReplyCSRF": "reply"}, true},
+	}
+	for _, test := range tests {
+		test.info["Links"] = []*Link{link}
+		var buf bytes.Buffer
+		err := views.Execute(&buf, "inks.html", test.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if form := strings.Contains(buf.String(), "/moderatereply"); form != test.form {
+			t.Errorf("%s sees moderation form: %v", test.role, form)
+		}
+	}
+}
@@ -35,7 +35,6 @@ import "C"
 import (
 	"bufio"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha512"
 	"database/sql"
 	"fmt"
@@ -48,7 +47,6 @@ import (
 
 	"golang.org/x/crypto/bcrypt"
 	_ "humungus.tedunangst.com/r/go-sqlite3"
-	"humungus.tedunangst.com/r/webs/httpsig"
 )
 
 var savedstyleparams = make(map[string]string)
@@ -73,12 +71,24 @@ var alreadyopendb *sql.DB
 var dbname = "inks.db"
 var stmtConfig *sql.Stmt
 
-func initdb() {
-	schema, err := ioutil.ReadFile("schema.sql")
+// runsql runs the statements in a file. They end at line ends, since
+// triggers have more semicolons inside.
+func runsql(db *sql.DB, filename string) error {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	_, err = os.Stat(dbname)
+	for _, stmt := range strings.Split(string(data), ";\n") {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("%s: %s", stmt, err)
+		}
+	}
+	return nil
+}
+
+func initdb() {
+	_, err := os.Stat(dbname)
 	if err == nil {
 		log.Fatalf("%s already exists", dbname)
 	}
@@ -101,12 +111,10 @@ func initdb() {
 		os.Exit(1)
 	}()
 
-	for _, line := range strings.Split(string(schema), ";") {
-		_, err = db.Exec(line)
-		if err != nil {
-			log.Print(err)
-			return
-		}
+	err = runsql(db, "schema.sql")
+	if err != nil {
+		log.Print(err)
+		return
 	}
 	defer db.Close()
 	r := bufio.NewReader(os.Stdin)
@@ -121,26 +129,17 @@ func initdb() {
 		log.Print("that's way too short")
 		return
 	}
-	C.termecho(0)
-	fmt.Printf("password: ")
-	pass, err := r.ReadString('\n')
-	C.termecho(1)
-	fmt.Printf("\n")
+	pass, err := askpassword(r)
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	pass = pass[:len(pass)-1]
-	if len(pass) < 6 {
-		log.Print("that's way too short")
-		return
-	}
 	hash, err := bcrypt.GenerateFromPassword([]byte(pass), 12)
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	_, err = db.Exec("insert into users (username, hash) values (?, ?)", name, hash)
+	_, err = db.Exec("insert into users (username, hash, role) values (?, ?, ?)", name, hash, "admin")
 	if err != nil {
 		log.Print(err)
 		return
@@ -186,12 +185,7 @@ func initdb() {
 		return
 	}
 	setconfig("dbversion", dbVersion)
-	k, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	pubkey, err := httpsig.EncodeKey(&k.PublicKey)
+	pubkey, seckey, err := generatekeys()
 	if err != nil {
 		log.Print(err)
 		return
@@ -201,11 +195,6 @@ func initdb() {
 		log.Print(err)
 		return
 	}
-	seckey, err := httpsig.EncodeKey(k)
-	if err != nil {
-		log.Print(err)
-		return
-	}
 	_, err = db.Exec("insert into config (key, value) values (?, ?)", "seckey", seckey)
 	if err != nil {
 		log.Print(err)
@@ -217,9 +206,29 @@ func initdb() {
 	os.Exit(0)
 }
 
+func askpassword(r *bufio.Reader) (string, error) {
+	C.termecho(0)
+	fmt.Printf("password: ")
+	pass, err := r.ReadString('\n')
+	C.termecho(1)
+	fmt.Printf("\n")
+	if err != nil {
+		return "", err
+	}
+	pass = pass[:len(pass)-1]
+	if len(pass) < 6 {
+		return "", fmt.Errorf("that's way too short")
+	}
+	return pass, nil
+}
+
 func setconfig(key string, val interface{}) error {
 	db := opendatabase()
-	_, err := db.Exec("insert into config (key, value) values (?, ?)", key, val)
+	_, err := db.Exec("delete from config where key = ?", key)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("insert into config (key, value) values (?, ?)", key, val)
 	return err
 }
 